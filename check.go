@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const COMMAND_CHECK = "check"
+
+// Nagios/Icinga plugin exit codes
+const NAGIOS_OK = 0
+const NAGIOS_WARNING = 1
+const NAGIOS_CRITICAL = 2
+const NAGIOS_UNKNOWN = 3
+
+const DEFAULT_CHECK_WARNING = 72 * time.Hour
+const DEFAULT_CHECK_CRITICAL = 24 * time.Hour
+
+var NAGIOS_STATUS_NAMES = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+var errInvalidCheckThresholds = errors.New("--warning and --critical must be greater than 0, and --critical no longer than --warning")
+
+// fetch metadata and report it as a Nagios plugin; returns the exit code. Failing to fetch is UNKNOWN.
+func runCheck(writer io.Writer, opt *collect_options) int {
+	fetchedMetadata, err := fetchMetadata(opt)
+	if err != nil {
+		return writeCheckUnknown(writer, err)
+	}
+	return writeCheck(writer, fetchedMetadata, time.Now(), opt.checkWarning, opt.checkCritical)
+}
+
+func writeCheckUnknown(writer io.Writer, err error) int {
+	fmt.Fprintf(writer, "%s - %s\n", NAGIOS_STATUS_NAMES[NAGIOS_UNKNOWN], err)
+	return NAGIOS_UNKNOWN
+}
+
+// write the plugin output line (status, summary and perfdata) and return the exit code.
+//
+// A pending event starting within `critical` (or already in its window) is CRITICAL, within `warning`
+// is WARNING. A pending spot interruption is always CRITICAL.
+func writeCheck(writer io.Writer, metadata *fetched_metadata, now time.Time, warning, critical time.Duration) int {
+	status := NAGIOS_OK
+	var messages []string
+	pendingCount := 0
+	var nextStart *time.Duration
+
+	if metadata.spotAction != nil {
+		deadline, err := time.Parse(time.RFC3339, metadata.spotAction.Time)
+		if err != nil {
+			return writeCheckUnknown(writer, err)
+		}
+		status = NAGIOS_CRITICAL
+		messages = append(messages, fmt.Sprintf("spot %s in %s", metadata.spotAction.Action, humanDuration(deadline.Sub(now))))
+	}
+
+	for _, ev := range metadata.events {
+		if !eventPending(ev) {
+			continue
+		}
+		notBefore, _, err := parseEventWindow(ev)
+		if err != nil {
+			return writeCheckUnknown(writer, err)
+		}
+		pendingCount++
+		lead := notBefore.Sub(now)
+		if nextStart == nil || lead < *nextStart {
+			nextStart = &lead
+		}
+
+		eventStatus := NAGIOS_OK
+		switch {
+		case lead <= critical:
+			eventStatus = NAGIOS_CRITICAL
+		case lead <= warning:
+			eventStatus = NAGIOS_WARNING
+		}
+		status = max(status, eventStatus)
+
+		when := "starts in " + humanDuration(lead)
+		if inWindow, _ := inEventWindow(ev, now); inWindow {
+			when = "in window"
+		} else if lead < 0 {
+			when = "window passed"
+		}
+		messages = append(messages, fmt.Sprintf("%s %s %s", ev.Code, ev.EventId, when))
+	}
+
+	summary := "no pending maintenance on " + metadata.instanceID
+	if len(messages) > 0 {
+		summary = metadata.instanceID + ": " + strings.Join(messages, ", ")
+	}
+
+	// 'label'=value[UOM];[warn];[crit];[min];[max]; next_start alerts inside the range, i.e. below the threshold
+	perfdata := fmt.Sprintf("events=%d;;;0 pending_events=%d;;;0", len(metadata.events), pendingCount)
+	if nextStart != nil {
+		perfdata += fmt.Sprintf(" next_start=%ds;@~:%d;@~:%d",
+			int64(nextStart.Seconds()), int64(warning.Seconds()), int64(critical.Seconds()))
+	}
+
+	fmt.Fprintf(writer, "%s - %s | %s\n", NAGIOS_STATUS_NAMES[status], summary, perfdata)
+	return status
+}
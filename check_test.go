@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_writeCheck(t *testing.T) {
+	now := time.Date(2020, 1, 20, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		metadata   *fetched_metadata
+		want       string
+		wantStatus int
+	}{
+		{name: "nothing scheduled",
+			metadata:   &fetched_metadata{instanceID: "i-jklmn"},
+			want:       `^OK - no pending maintenance on i-jklmn \| events=0;;;0 pending_events=0;;;0\n$`,
+			wantStatus: NAGIOS_OK,
+		},
+		{name: "far off",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				events: []maintenance_event{{Code: "system-reboot", EventId: "ev-1", State: "active", NotBefore: "30 Jan 2020 10:00:00 GMT"}}},
+			want:       `^OK - i-jklmn: system-reboot ev-1 starts in 10d 0h \| events=1;;;0 pending_events=1;;;0 next_start=864000s;@~:259200;@~:86400\n$`,
+			wantStatus: NAGIOS_OK,
+		},
+		{name: "within warning",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				events: []maintenance_event{{Code: "system-reboot", EventId: "ev-1", State: "active", NotBefore: "22 Jan 2020 10:00:00 GMT"}}},
+			want:       `^WARNING - i-jklmn: system-reboot ev-1 starts in 2d 0h \|.* next_start=172800s;`,
+			wantStatus: NAGIOS_WARNING,
+		},
+		{name: "worst event wins",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				events: []maintenance_event{
+					{Code: "system-reboot", EventId: "ev-1", State: "active", NotBefore: "22 Jan 2020 10:00:00 GMT"},
+					{Code: "instance-stop", EventId: "ev-2", State: "active", NotBefore: "20 Jan 2020 12:00:00 GMT"},
+				}},
+			want:       `^CRITICAL - i-jklmn: system-reboot ev-1 starts in 2d 0h, instance-stop ev-2 starts in 2h 0m \| events=2;;;0 pending_events=2;;;0 next_start=7200s;`,
+			wantStatus: NAGIOS_CRITICAL,
+		},
+		{name: "in window",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				events: []maintenance_event{{Code: "system-reboot", EventId: "ev-1", State: "active",
+					NotBefore: "20 Jan 2020 09:00:00 GMT", NotAfter: "20 Jan 2020 11:00:00 GMT"}}},
+			want:       `^CRITICAL - i-jklmn: system-reboot ev-1 in window \|.* next_start=-3600s;`,
+			wantStatus: NAGIOS_CRITICAL,
+		},
+		{name: "completed and canceled are ignored",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				events: []maintenance_event{
+					{Code: "system-reboot", EventId: "ev-1", State: "completed", NotBefore: "20 Jan 2020 09:00:00 GMT"},
+					{Code: "system-reboot", EventId: "ev-2", State: "canceled", NotBefore: "20 Jan 2020 11:00:00 GMT"},
+				}},
+			want:       `^OK - no pending maintenance on i-jklmn \| events=2;;;0 pending_events=0;;;0\n$`,
+			wantStatus: NAGIOS_OK,
+		},
+		{name: "spot interruption",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				spotAction: &spot_instance_action{Action: "terminate", Time: "2020-01-20T10:02:00Z"}},
+			want:       `^CRITICAL - i-jklmn: spot terminate in 2m \|`,
+			wantStatus: NAGIOS_CRITICAL,
+		},
+		{name: "bad NotBefore",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				events: []maintenance_event{{State: "active", NotBefore: "soon"}}},
+			want:       `^UNKNOWN - parsing time "soon"`,
+			wantStatus: NAGIOS_UNKNOWN,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			status := writeCheck(&buf, tt.metadata, now, DEFAULT_CHECK_WARNING, DEFAULT_CHECK_CRITICAL)
+			if status != tt.wantStatus {
+				t.Errorf("writeCheck() = %d, want %d", status, tt.wantStatus)
+			}
+			if !regexp.MustCompile(tt.want).MatchString(buf.String()) {
+				t.Errorf("writeCheck() wrote `%s`, wanted it to match %s", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func Test_runCheck_unknown(t *testing.T) {
+	helpNoRetrySleep(t)
+	srv := helpMakeAServer(
+		func(w http.ResponseWriter) { http.Error(w, "meta-data unavailable", 500) },
+		func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+	)
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	opt := helpDefaultOptions(func(o *collect_options) { o.baseURL = srv.URL; o.retries = 0 })
+	if status := runCheck(&buf, opt); status != NAGIOS_UNKNOWN {
+		t.Errorf("runCheck() = %d, want %d (%s)", status, NAGIOS_UNKNOWN, buf.String())
+	}
+	if !regexp.MustCompile(`^UNKNOWN - .*500`).MatchString(buf.String()) {
+		t.Errorf("runCheck() wrote `%s`", buf.String())
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -8,7 +9,15 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -16,18 +25,94 @@ const DEFAULT_BASE_URL = "http://169.254.169.254"
 const DEFAULT_SCHEDULED_PATH = "/latest/meta-data/events/maintenance/scheduled"
 const DEFAULT_INSTANCE_ID_PATH = "/1.0/meta-data/instance-id"
 const DEFAULT_TOKEN_PATH = "/latest/api/token"
-const TOKEN_TTL = "21600" // 6 hours in seconds
+const DEFAULT_SPOT_ACTION_PATH = "/latest/meta-data/spot/instance-action"
+const DEFAULT_REBALANCE_PATH = "/latest/meta-data/events/recommendations/rebalance"
+const DEFAULT_AUTOSCALING_STATE_PATH = "/latest/meta-data/autoscaling/target-lifecycle-state"
+const DEFAULT_IDENTITY_DOCUMENT_PATH = "/latest/dynamic/instance-identity/document"
+const DEFAULT_LIFE_CYCLE_PATH = "/latest/meta-data/instance-life-cycle"
+const DEFAULT_TAGS_PATH = "/latest/meta-data/tags/instance"
+const DEFAULT_TOKEN_TTL = 6 * time.Hour
+const MIN_TOKEN_TTL = time.Second   // shortest TTL IMDS will issue a token for
+const MAX_TOKEN_TTL = 6 * time.Hour // longest TTL IMDS will issue a token for
+const TOKEN_REFRESH_MARGIN = 5 * time.Minute
+const DEFAULT_INTERVAL = 5 * time.Minute
+const DEFAULT_JITTER = 30 * time.Second
+const DEFAULT_LISTEN_ADDRESS = ":9877"
+const DEFAULT_CONNECT_TIMEOUT = 2 * time.Second
+const DEFAULT_REQUEST_TIMEOUT = 5 * time.Second
+const DEFAULT_RETRIES = 3
+const IMDS_VERSION_AUTO = "auto"
+const IMDS_VERSION_V1 = "v1"
+const IMDS_VERSION_V2 = "v2"
+const METRICS_SCHEMA_V1 = "v1"
+const METRICS_SCHEMA_V2 = "v2"
+const AWS_EVENT_TIME_FORMAT = "2 Jan 2006 15:04:05 GMT"
+const COMMAND_COLLECT = "collect"
+const COMMAND_SERVE = "serve"
 const MY_PROGRAM_NAME = "collect-aws-metadata"
 
 var VERSION string // to set this, build with --ldflags="-X main.VERSION=vx.y.z"
 
+// maintenance event states and codes, written as state sets
+var MAINTENANCE_EVENT_STATES = []string{"active", "completed", "canceled"}
+var MAINTENANCE_EVENT_CODES = []string{
+	"instance-reboot",
+	"system-reboot",
+	"system-maintenance",
+	"instance-retirement",
+	"instance-stop",
+}
+
+// every value of autoscaling/target-lifecycle-state, so each one gets a 0 or 1 series
+var AUTOSCALING_LIFECYCLE_STATES = []string{
+	"Detached",
+	"InService",
+	"Standby",
+	"Terminated",
+	"Warmed:Hibernated",
+	"Warmed:Running",
+	"Warmed:Stopped",
+	"Warmed:Terminated",
+}
+
 // make these replaceable in a test
 var logFatalf func(format string, v ...interface{}) = log.Fatalf
 var osExit func(code int) = os.Exit
 
+// shared by every IMDS request, so a daemon reuses its connections between polls
+var imdsHTTPClient = &http.Client{}
+
 type collect_options struct {
+	command                              string
 	baseURL, metricPrefix, textfilesPath string
+	metricsSchema                        string // METRICS_SCHEMA_V1 or _V2
+	format                               string // FORMAT_PROMETHEUS, FORMAT_OPENMETRICS or FORMAT_JSON
+	output                               string // file to write instead of one in textfilesPath; "-" for stdout
+	daemon, autoscaling, imdsUseProxy    bool
+	interval, jitter                     time.Duration
+	fileMode                             os.FileMode
+	fileUID, fileGID                     int
+	listenAddress                        string
+	tlsCertFile, tlsKeyFile              string
+	basicAuthUser, basicAuthPasswordFile string
+	instanceTags                         []string // allowlist of tag keys to label aws_instance_info with
+	connectTimeout, requestTimeout       time.Duration
+	retries                              int
+	imdsVersion                          string // IMDS_VERSION_AUTO, _V1 or _V2
+	endpointMode                         string // ENDPOINT_MODE_IPV4, _IPV6 or _AUTO
+	tokenCachePath                       string
+	tokenTTL                             time.Duration
+	checkWarning, checkCritical          time.Duration // check's lead-time thresholds
+	hookCommand, hookStatePath           string
+	hookLeadTimes                        []time.Duration // longest first
+	hookTimeout                          time.Duration
+	statePath                            string // where to keep events between runs, to see what changed
+	webhookURL, webhookSecretFile        string
+	slackWebhookURL, slackWebhookURLFile string
+	slackTokenFile, slackChannel         string
+	notifyLedgerPath                     string
 	token                                string
+	tokenExpires                         time.Time
 }
 
 type maintenance_event struct {
@@ -39,9 +124,43 @@ type maintenance_event struct {
 	State       string `json:"State"`       //     "active", "completed", "canceled"
 }
 
+type spot_instance_action struct {
+	Action string `json:"action"` //     "stop", "terminate", "hibernate"
+	Time   string `json:"time"`   //     "2017-09-18T08:22:00Z"
+}
+
+type rebalance_recommendation struct {
+	NoticeTime string `json:"noticeTime"` //     "2020-10-27T08:22:00Z"
+}
+
+// the parts of the instance identity document we label metrics with
+type instance_identity struct {
+	AccountId        string `json:"accountId"`        //     "123456789012"
+	AvailabilityZone string `json:"availabilityZone"` //     "us-east-1a"
+	ImageId          string `json:"imageId"`          //     "ami-0abcdef1234567890"
+	InstanceType     string `json:"instanceType"`     //     "m5.large"
+	Region           string `json:"region"`           //     "us-east-1"
+}
+
+type instance_tag struct {
+	key, value string
+}
+
 type fetched_metadata struct {
 	instanceID string
-	events     []maintenance_event
+	identity   instance_identity
+	lifeCycle  string         // "on-demand", "spot", "scheduled"
+	tags       []instance_tag // one per --instance-tags key, in that order; value "" if the tag isn't set
+
+	imdsVersion int // 2 if the requests used an IMDSv2 token, 1 if they fell back to IMDSv1
+	events      []maintenance_event
+	spotAction  *spot_instance_action     // nil unless a spot interruption is pending
+	rebalance   *rebalance_recommendation // nil unless EC2 has recommended a rebalance
+
+	// "" unless --autoscaling is set and the instance is in an Auto Scaling group
+	lifecycleState string
+
+	eventChanges map[string]int64 // counts by CHANGE_ kind; nil unless --state-path is set
 }
 
 type HTTPErrorStatusCode struct {
@@ -56,6 +175,20 @@ func (e *HTTPErrorStatusCode) Error() string {
 
 var errMissingTextfilesPath = errors.New("required: --textfiles-path")
 var errShowVersion = errors.New("(not an error) --version override")
+var errInvalidInterval = errors.New("--interval must be greater than 0")
+var errInvalidJitter = errors.New("--jitter must not be negative")
+var errIncompleteTLS = errors.New("--tls-cert-file and --tls-key-file must be used together")
+var errIncompleteBasicAuth = errors.New("--basic-auth-user and --basic-auth-password-file must be used together")
+var errInvalidTimeout = errors.New("--connect-timeout and --request-timeout must be greater than 0")
+var errInvalidRetries = errors.New("--retries must not be negative")
+var errInvalidMetricsSchema = errors.New("--metrics-schema must be one of: v1, v2")
+var errInvalidIMDSVersion = errors.New("--imds-version must be one of: auto, v1, v2")
+var errInvalidTokenTTL = errors.New("--token-ttl must be a whole number of seconds from 1s to 6h")
+var errIMDSv2Unavailable = errors.New("no IMDSv2 token, and --imds-version=v2 does not allow falling back to IMDSv1")
+var errDuplicateTagLabel = errors.New("--instance-tags has two keys that make the same label name")
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
 
 // test `e`, write a message using the standard error format (and exit) if it is an error
 func check(e error) {
@@ -64,6 +197,13 @@ func check(e error) {
 	}
 }
 
+// uses log.Println to write an error message using the standard error format, without exiting
+func printError(e error) string {
+	ret := "** " + MY_PROGRAM_NAME + ": " + e.Error()
+	log.Println(ret)
+	return ret
+}
+
 // uses log.Println to write an info message using a standard format
 func printInfo(msg string) string {
 	ret := MY_PROGRAM_NAME + ": " + msg
@@ -71,62 +211,246 @@ func printInfo(msg string) string {
 	return ret
 }
 
+// escape a label value for the Prometheus text format
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// the label name an instance tag key is exported as, e.g. "aws:cloudformation:stack-name" -> "tag_aws_cloudformation_stack_name"
+func tagLabelName(key string) string {
+	return "tag_" + invalidLabelChars.ReplaceAllString(key, "_")
+}
+
 // create a textfile for Prometheus to read from the events, using the output argument (an open file)
-func writeMetrics(writer io.Writer, metadata *fetched_metadata, prefix string) error {
-	_, err := fmt.Fprintf(writer,
-		"%saws_maintenance_event_count{cloud_instance=\"%s\"} %d\n",
-		prefix,
-		metadata.instanceID,
-		len(metadata.events),
-	)
+//
+// `schema` only changes how maintenance events are written; see writeEventsV1 and writeEventsV2. `format`
+// is FORMAT_PROMETHEUS or FORMAT_OPENMETRICS.
+func writeMetrics(writer io.Writer, metadata *fetched_metadata, prefix string, schema string, format string) error {
+	set := newMetricSet(prefix)
+	instance := label{"cloud_instance", metadata.instanceID}
+
+	infoLabels := []label{
+		instance,
+		{"instance_type", metadata.identity.InstanceType},
+		{"availability_zone", metadata.identity.AvailabilityZone},
+		{"region", metadata.identity.Region},
+		{"ami_id", metadata.identity.ImageId},
+		{"instance_life_cycle", metadata.lifeCycle},
+		{"account_id", metadata.identity.AccountId},
+	}
+	for _, tag := range metadata.tags {
+		infoLabels = append(infoLabels, label{tagLabelName(tag.key), tag.value})
+	}
+	set.family("aws_instance_info", METRIC_TYPE_INFO,
+		"Instance metadata, as labels. Always 1.").add(1, infoLabels...)
+
+	set.family("aws_imds_version_used", METRIC_TYPE_GAUGE,
+		"IMDS version used to fetch metadata: 2 with a session token, 1 without.").add(float64(metadata.imdsVersion), instance)
+
+	set.family("aws_maintenance_event_count", METRIC_TYPE_GAUGE,
+		"Number of scheduled maintenance events.").add(float64(len(metadata.events)), instance)
+
+	// any event in its window; for suppressing alerts on this instance while maintenance is under way
+	windowActive := false
+	for _, ev := range metadata.events {
+		inWindow, err := inEventWindow(ev, time.Now())
+		if err != nil {
+			return err
+		}
+		windowActive = windowActive || inWindow
+	}
+	set.family("aws_maintenance_window_active", METRIC_TYPE_GAUGE,
+		"1 while any scheduled maintenance event is inside its window, else 0.").add(boolToFloat(windowActive), instance)
+
+	var err error
+	if schema == METRICS_SCHEMA_V1 {
+		err = writeEventsV1(set, metadata)
+	} else {
+		err = writeEventsV2(set, metadata)
+	}
 	if err != nil {
 		return err
 	}
 
+	set.family("aws_spot_instance_action_count", METRIC_TYPE_GAUGE,
+		"1 if a spot interruption notice is pending, else 0.").add(boolToFloat(metadata.spotAction != nil), instance)
+
+	spotAction := set.family("aws_spot_instance_action", METRIC_TYPE_GAUGE,
+		"Deadline for the pending spot interruption action, unix time.")
+	if metadata.spotAction != nil {
+		actionTime, err := time.Parse(time.RFC3339, metadata.spotAction.Time)
+		if err != nil {
+			return err
+		}
+		spotAction.add(float64(actionTime.Unix()), instance, label{"action", metadata.spotAction.Action})
+	}
+
+	rebalance := set.family("aws_rebalance_recommendation_timestamp", METRIC_TYPE_GAUGE,
+		"When EC2 recommended rebalancing this instance, unix time.")
+	if metadata.rebalance != nil {
+		noticeTime, err := time.Parse(time.RFC3339, metadata.rebalance.NoticeTime)
+		if err != nil {
+			return err
+		}
+		rebalance.add(float64(noticeTime.Unix()), instance)
+	}
+
+	if metadata.lifecycleState != "" {
+		writeLifecycleState(set, metadata)
+	}
+
+	if metadata.eventChanges != nil {
+		changes := set.family("aws_maintenance_event_changes_total", METRIC_TYPE_COUNTER,
+			"Maintenance event changes seen since the --state-path file was created, by kind.")
+		for _, kind := range EVENT_CHANGE_KINDS {
+			changes.add(float64(metadata.eventChanges[kind]), instance, label{"change", kind})
+		}
+	}
+	return set.write(writer, format)
+}
+
+// the legacy (--metrics-schema=v1) event metric: NotBefore as the value, with the date and days until
+// it as labels. Those labels change every day, which starts a new series; v2 avoids that.
+func writeEventsV1(set *metric_set, metadata *fetched_metadata) error {
+	events := set.family("aws_maintenance_event", METRIC_TYPE_GAUGE,
+		"Scheduled maintenance event start (NotBefore), unix time.")
 	for _, ev := range metadata.events {
-		evTime, err := time.Parse("2 Jan 2006 15:04:05 GMT", ev.NotBefore)
+		evTime, err := time.Parse(AWS_EVENT_TIME_FORMAT, ev.NotBefore)
 		if err != nil {
 			return err
 		}
-		_, err = fmt.Fprintf(writer,
-			"%saws_maintenance_event{cloud_instance=\"%s\", event_code=\"%s\", event_id=\"%s\", event_state=\"%s\", event_date=\"%s\", days_hence=\"%d\"} %d\n",
-			prefix,
-			metadata.instanceID,
-			ev.Code,
-			ev.EventId,
-			ev.State,
-			evTime.Format("Mon 2006/01/02"), // formatted date of event, with weekday
-			int64(evTime.Sub(time.Now()).Hours()/24), // duration (in days) until event
-			evTime.Unix(), // timestamp
+		events.add(float64(evTime.Unix()),
+			label{"cloud_instance", metadata.instanceID},
+			label{"event_code", ev.Code},
+			label{"event_id", ev.EventId},
+			label{"event_state", ev.State},
+			label{"event_date", evTime.Format("Mon 2006/01/02")},                                 // formatted date of event, with weekday
+			label{"days_hence", strconv.FormatInt(int64(evTime.Sub(time.Now()).Hours()/24), 10)}, // duration (in days) until event
 		)
+	}
+	return nil
+}
+
+// parse an event's window. notAfter is the zero time if the event has no NotAfter.
+func parseEventWindow(ev maintenance_event) (notBefore, notAfter time.Time, err error) {
+	notBefore, err = time.Parse(AWS_EVENT_TIME_FORMAT, ev.NotBefore)
+	if err != nil {
+		return notBefore, notAfter, err
+	}
+	if ev.NotAfter != "" {
+		notAfter, err = time.Parse(AWS_EVENT_TIME_FORMAT, ev.NotAfter)
+	}
+	return notBefore, notAfter, err
+}
+
+// whether `now` is inside the event's window. An event without a NotAfter stays in its window once it
+// starts, until AWS marks it completed or canceled.
+func inEventWindow(ev maintenance_event, now time.Time) (bool, error) {
+	if ev.State == "completed" || ev.State == "canceled" {
+		return false, nil
+	}
+	notBefore, notAfter, err := parseEventWindow(ev)
+	if err != nil {
+		return false, err
+	}
+	return !now.Before(notBefore) && (notAfter.IsZero() || now.Before(notAfter)), nil
+}
+
+// event metrics with labels that stay the same for the life of an event (only event_state can change),
+// and the times as values
+func writeEventsV2(set *metric_set, metadata *fetched_metadata) error {
+	notBeforeFamily := set.family("aws_maintenance_event_not_before_timestamp_seconds", METRIC_TYPE_GAUGE,
+		"Scheduled maintenance event window start (NotBefore), unix time.").withUnit("seconds")
+	notAfterFamily := set.family("aws_maintenance_event_not_after_timestamp_seconds", METRIC_TYPE_GAUGE,
+		"Scheduled maintenance event window end (NotAfter), unix time.").withUnit("seconds")
+	windowFamily := set.family("aws_maintenance_event_window_seconds", METRIC_TYPE_GAUGE,
+		"Length of the scheduled maintenance event window.").withUnit("seconds")
+	untilStartFamily := set.family("aws_maintenance_event_until_start_seconds", METRIC_TYPE_GAUGE,
+		"Seconds until the scheduled maintenance event window starts; negative once it has.").withUnit("seconds")
+	inWindowFamily := set.family("aws_maintenance_event_in_window", METRIC_TYPE_GAUGE,
+		"1 while the scheduled maintenance event is inside its window, else 0.")
+	stateFamily := set.stateSet("aws_maintenance_event_state", "event_state",
+		"Scheduled maintenance event state; 1 for the current state, 0 for the others.")
+	codeFamily := set.stateSet("aws_maintenance_event_code", "event_code",
+		"Scheduled maintenance event code; 1 for the event's code, 0 for the others.")
+
+	now := time.Now()
+	for _, ev := range metadata.events {
+		notBefore, notAfter, err := parseEventWindow(ev)
 		if err != nil {
 			return err
 		}
+		labels := []label{
+			{"cloud_instance", metadata.instanceID},
+			{"event_code", ev.Code},
+			{"event_id", ev.EventId},
+			{"event_state", ev.State},
+		}
+
+		notBeforeFamily.add(float64(notBefore.Unix()), labels...)
+		if !notAfter.IsZero() {
+			notAfterFamily.add(float64(notAfter.Unix()), labels...)
+			windowFamily.add(float64(int64(notAfter.Sub(notBefore).Seconds())), labels...)
+		}
+		untilStartFamily.add(float64(int64(notBefore.Sub(now).Seconds())), labels...)
+
+		inWindow, _ := inEventWindow(ev, now) // already parsed above
+		inWindowFamily.add(boolToFloat(inWindow), labels...)
+
+		// keyed by event id only, so the state or code is in the state label and nowhere else
+		eventLabels := []label{{"cloud_instance", metadata.instanceID}, {"event_id", ev.EventId}}
+		for _, state := range withUnknownState(MAINTENANCE_EVENT_STATES, ev.State) {
+			stateFamily.addState(state, state == ev.State, eventLabels...)
+		}
+		for _, code := range withUnknownState(MAINTENANCE_EVENT_CODES, ev.Code) {
+			codeFamily.addState(code, code == ev.Code, eventLabels...)
+		}
 	}
 	return nil
 }
 
-// Function to fetch IMDSv2 token
-func fetchToken(baseURL string) (string, error) {
-	client := &http.Client{}
+// 1 for true, 0 for false, as Prometheus likes it
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// the known states, plus `current` if it isn't one of them (a state AWS added after this was written;
+// still report it)
+func withUnknownState(known []string, current string) []string {
+	if current == "" || slices.Contains(known, current) {
+		return known
+	}
+	return append(slices.Clone(known), current)
+}
+
+// a state set: one series per known lifecycle state, 1 for the current one and 0 for the rest
+func writeLifecycleState(set *metric_set, metadata *fetched_metadata) {
+	family := set.stateSet("aws_autoscaling_target_lifecycle_state", "state",
+		"Auto Scaling target lifecycle state; 1 for the current state, 0 for the others.")
+	for _, state := range withUnknownState(AUTOSCALING_LIFECYCLE_STATES, metadata.lifecycleState) {
+		family.addState(state, state == metadata.lifecycleState, label{"cloud_instance", metadata.instanceID})
+	}
+}
+
+// Function to fetch IMDSv2 token, good for `ttl` (whole seconds, MIN_TOKEN_TTL to MAX_TOKEN_TTL)
+func fetchToken(baseURL string, ttl time.Duration) (string, error) {
 	req, err := http.NewRequest("PUT", baseURL+DEFAULT_TOKEN_PATH, nil)
 	if err != nil {
 		return "", err
 	}
 
-	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", TOKEN_TTL)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(ttl/time.Second)))
 
-	resp, err := client.Do(req)
+	resp, err := imdsHTTPClient.Do(req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
 
-	// If we get a 403 or 404, the instance might be using IMDSv1
-	if resp.StatusCode == 403 || resp.StatusCode == 404 {
-		return "", nil
-	}
-
+	// a 403 or 404 (IMDSv1 only) is an error too, so ensureToken can say why there is no token
 	if resp.StatusCode != 200 {
 		return "", &HTTPErrorStatusCode{url: baseURL + DEFAULT_TOKEN_PATH, code: resp.StatusCode, message: resp.Status}
 	}
@@ -141,7 +465,6 @@ func fetchToken(baseURL string) (string, error) {
 
 // Update fetchURL to use token if available
 func fetchURL(url string, token string) ([]byte, error) {
-	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -152,44 +475,71 @@ func fetchURL(url string, token string) ([]byte, error) {
 		req.Header.Set("X-aws-ec2-metadata-token", token)
 	}
 
-	resp, err := client.Do(req)
+	resp, err := imdsHTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != 200 {
 		return nil, &HTTPErrorStatusCode{url: url, code: resp.StatusCode, message: resp.Status}
 	}
 
-	if resp.Body != nil {
-		defer resp.Body.Close()
-	}
-
-	body, _ := io.ReadAll(resp.Body)
-	return body, nil
+	return io.ReadAll(resp.Body)
 }
 
 // Update fetchMetadata to use token
 func fetchMetadata(opt *collect_options) (*fetched_metadata, error) {
 	ret := &fetched_metadata{}
+
+	// --endpoint-mode=auto; probed on first use, and again on the next poll if neither answered
+	if opt.baseURL == "" {
+		if err := probeEndpoint(opt); err != nil {
+			return nil, err
+		}
+	}
 	eventsURL := opt.baseURL + DEFAULT_SCHEDULED_PATH
-	instanceURL := opt.baseURL + DEFAULT_INSTANCE_ID_PATH
 
-	// Try to fetch token first (for IMDSv2)
-	token, err := fetchToken(opt.baseURL)
+	instance, err := fetchPath(opt, DEFAULT_INSTANCE_ID_PATH)
 	if err != nil {
 		return nil, err
 	}
-	opt.token = token
 
-	instance, err := fetchURL(instanceURL, opt.token)
+	ret.instanceID = string(instance)
+
+	// the token is settled by the first request; an empty one means IMDSv1
+	ret.imdsVersion = 1
+	if opt.token != "" {
+		ret.imdsVersion = 2
+	}
+
+	// labels for aws_instance_info; missing pieces are left blank rather than failing the run
+	identity, err := fetchOptionalPath(opt, DEFAULT_IDENTITY_DOCUMENT_PATH)
 	if err != nil {
 		return nil, err
 	}
+	if identity != nil {
+		err = json.Unmarshal(identity, &ret.identity)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	ret.instanceID = string(instance)
+	lifeCycle, err := fetchOptionalPath(opt, DEFAULT_LIFE_CYCLE_PATH)
+	if err != nil {
+		return nil, err
+	}
+	ret.lifeCycle = strings.TrimSpace(string(lifeCycle))
 
-	body, err := fetchURL(eventsURL, opt.token)
+	if len(opt.instanceTags) > 0 {
+		ret.tags, err = fetchInstanceTags(opt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body, err := fetchPath(opt, DEFAULT_SCHEDULED_PATH)
 	if err != nil {
 		return nil, err
 	}
@@ -201,14 +551,109 @@ func fetchMetadata(opt *collect_options) (*fetched_metadata, error) {
 	counted := fmt.Sprintf("Fetched %s; %d events", eventsURL, len(ret.events))
 	printInfo(counted)
 
+	// only present while a spot interruption is pending, and always 404 on on-demand instances
+	spotURL := opt.baseURL + DEFAULT_SPOT_ACTION_PATH
+	body, err = fetchOptionalPath(opt, DEFAULT_SPOT_ACTION_PATH)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		ret.spotAction = &spot_instance_action{}
+		err = json.Unmarshal(body, ret.spotAction)
+		if err != nil {
+			return nil, err
+		}
+		printInfo(fmt.Sprintf("Fetched %s; spot instance action %s at %s", spotURL, ret.spotAction.Action, ret.spotAction.Time))
+	}
+
+	// usually arrives before a spot interruption notice; also 404 until there is one
+	rebalanceURL := opt.baseURL + DEFAULT_REBALANCE_PATH
+	body, err = fetchOptionalPath(opt, DEFAULT_REBALANCE_PATH)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		ret.rebalance = &rebalance_recommendation{}
+		err = json.Unmarshal(body, ret.rebalance)
+		if err != nil {
+			return nil, err
+		}
+		printInfo(fmt.Sprintf("Fetched %s; rebalance recommended at %s", rebalanceURL, ret.rebalance.NoticeTime))
+	}
+
+	// opt-in, so hosts outside an Auto Scaling group make no extra request; 404 when not in one
+	if opt.autoscaling {
+		stateURL := opt.baseURL + DEFAULT_AUTOSCALING_STATE_PATH
+		body, err = fetchOptionalPath(opt, DEFAULT_AUTOSCALING_STATE_PATH)
+		if err != nil {
+			return nil, err
+		}
+		ret.lifecycleState = strings.TrimSpace(string(body))
+		if ret.lifecycleState != "" {
+			printInfo(fmt.Sprintf("Fetched %s; target lifecycle state %s", stateURL, ret.lifecycleState))
+		}
+	}
+
 	return ret, nil
 }
 
+// fetch the values of the allowlisted instance tags.
+//
+// Tags are only in IMDS when the instance has "instance metadata tags" enabled; otherwise the
+// listing is 404 and every tag comes back blank, so aws_instance_info keeps the same label names.
+func fetchInstanceTags(opt *collect_options) ([]instance_tag, error) {
+	tags := make([]instance_tag, len(opt.instanceTags))
+	for i, key := range opt.instanceTags {
+		tags[i].key = key
+	}
+
+	tagsURL := opt.baseURL + DEFAULT_TAGS_PATH
+	listing, err := fetchOptionalPath(opt, DEFAULT_TAGS_PATH)
+	if err != nil {
+		return nil, err
+	}
+	if listing == nil {
+		printInfo(fmt.Sprintf("Fetched %s; not found, instance metadata tags may not be enabled", tagsURL))
+		return tags, nil
+	}
+
+	// one key per line; keys may contain spaces
+	present := strings.Split(strings.TrimSpace(string(listing)), "\n")
+	for i := range tags {
+		if !slices.Contains(present, tags[i].key) {
+			continue
+		}
+		// a 404 means the tag was deleted since the listing; leave it blank, as if it weren't listed
+		value, err := fetchOptionalPath(opt, DEFAULT_TAGS_PATH+"/"+url.PathEscape(tags[i].key))
+		if err != nil {
+			return nil, err
+		}
+		tags[i].value = string(value)
+	}
+	return tags, nil
+}
+
+// parse the command line; an optional leading "serve" selects the HTTP exporter instead of the textfile,
+// "show" prints the metadata for a person, and "check" reports it as a Nagios plugin
 func parseArgs(args []string) (*collect_options, error) {
 	flagSet := flag.NewFlagSet(MY_PROGRAM_NAME, flag.ContinueOnError)
 
-	var ret collect_options
+	ret := collect_options{command: COMMAND_COLLECT}
+	if len(args) > 0 && slices.Contains([]string{COMMAND_SERVE, COMMAND_SHOW, COMMAND_CHECK}, args[0]) {
+		ret.command = args[0]
+		args = args[1:]
+	}
 
+	fileMode := flagSet.String(
+		"file-mode",
+		DEFAULT_FILE_MODE,
+		"Octal permissions for the textfile",
+	)
+	fileOwner := flagSet.String(
+		"file-owner",
+		"",
+		"Owner of the textfile as user[:group] (names or ids); by default, whoever runs this",
+	)
 	showVersion := flagSet.Bool(
 		"version",
 		false,
@@ -218,7 +663,43 @@ func parseArgs(args []string) (*collect_options, error) {
 		&ret.baseURL,
 		"base-url",
 		DEFAULT_BASE_URL,
-		"HTTP URL for the meta-data service (e.g. 'http://169.254.169.254')",
+		"HTTP URL for the meta-data service (e.g. 'http://169.254.169.254'); by default, chosen by --endpoint-mode",
+	)
+	flagSet.BoolVar(
+		&ret.imdsUseProxy,
+		"imds-use-proxy",
+		false,
+		"Send meta-data requests through the proxy in HTTP_PROXY/NO_PROXY (by default they always connect directly)",
+	)
+	flagSet.DurationVar(
+		&ret.tokenTTL,
+		"token-ttl",
+		DEFAULT_TOKEN_TTL,
+		"How long each IMDSv2 token is valid for (1s to 6h); it is refreshed shortly before it expires",
+	)
+	flagSet.DurationVar(
+		&ret.checkWarning,
+		"warning",
+		DEFAULT_CHECK_WARNING,
+		"With check, WARNING when a pending maintenance event starts within this long",
+	)
+	flagSet.DurationVar(
+		&ret.checkCritical,
+		"critical",
+		DEFAULT_CHECK_CRITICAL,
+		"With check, CRITICAL when a pending maintenance event starts within this long",
+	)
+	flagSet.StringVar(
+		&ret.tokenCachePath,
+		"token-cache-path",
+		"",
+		"Keep the IMDSv2 token in this file (created readable only by its owner) to reuse it across runs",
+	)
+	flagSet.StringVar(
+		&ret.endpointMode,
+		"endpoint-mode",
+		ENDPOINT_MODE_IPV4,
+		"Meta-data endpoint to use: 'ipv4', 'ipv6' or 'auto' to probe for one (default from "+ENV_ENDPOINT_MODE+", else ipv4)",
 	)
 	flagSet.StringVar(
 		&ret.metricPrefix,
@@ -226,11 +707,183 @@ func parseArgs(args []string) (*collect_options, error) {
 		"",
 		"Prometheus metric names will be given this prefix",
 	)
+	flagSet.StringVar(
+		&ret.format,
+		"format",
+		FORMAT_PROMETHEUS,
+		"Output format: 'prometheus' text format, 'openmetrics', or 'json'",
+	)
+	flagSet.StringVar(
+		&ret.output,
+		"output",
+		"",
+		"Write to this file instead of one in --textfiles-path; '-' for stdout",
+	)
+	flagSet.StringVar(
+		&ret.metricsSchema,
+		"metrics-schema",
+		METRICS_SCHEMA_V2,
+		"Maintenance event metrics to write: 'v2', or 'v1' for the legacy aws_maintenance_event with date labels",
+	)
 	flagSet.StringVar(
 		&ret.textfilesPath,
 		"textfiles-path",
 		"",
-		"(required) path to a directory of Prometheus metric textfiles, i.e. one being read by node_exporter",
+		"(required, except with serve) path to a directory of Prometheus metric textfiles, i.e. one being read by node_exporter",
+	)
+	flagSet.BoolVar(
+		&ret.daemon,
+		"daemon",
+		false,
+		"Keep running and collect every --interval, instead of collecting once and exiting",
+	)
+	flagSet.DurationVar(
+		&ret.interval,
+		"interval",
+		DEFAULT_INTERVAL,
+		"With --daemon or serve, how often to collect (e.g. '1m')",
+	)
+	flagSet.DurationVar(
+		&ret.jitter,
+		"jitter",
+		DEFAULT_JITTER,
+		"With --daemon or serve, add a random delay of up to this much to each --interval",
+	)
+	flagSet.BoolVar(
+		&ret.autoscaling,
+		"autoscaling",
+		false,
+		"Also collect the Auto Scaling target lifecycle state (for instances in an Auto Scaling group)",
+	)
+	flagSet.StringVar(
+		&ret.statePath,
+		"state-path",
+		"",
+		"JSON file to keep maintenance events in between runs, to log and count new, rescheduled, changed and vanished events",
+	)
+	flagSet.StringVar(
+		&ret.webhookURL,
+		"webhook-url",
+		"",
+		"POST a JSON notice here when a maintenance event is first seen, is rescheduled, or its window starts",
+	)
+	flagSet.StringVar(
+		&ret.webhookSecretFile,
+		"webhook-secret-file",
+		"",
+		"A file containing the key to sign --webhook-url notices with (HMAC-SHA256, in the X-Signature-256 header)",
+	)
+	flagSet.StringVar(
+		&ret.slackWebhookURL,
+		"slack-webhook-url",
+		"",
+		"Slack incoming webhook to post maintenance notices to; each notice is a message of its own. Visible in ps; prefer --slack-webhook-url-file",
+	)
+	flagSet.StringVar(
+		&ret.slackWebhookURLFile,
+		"slack-webhook-url-file",
+		"",
+		"A file containing the Slack incoming webhook URL, instead of --slack-webhook-url",
+	)
+	flagSet.StringVar(
+		&ret.slackTokenFile,
+		"slack-token-file",
+		"",
+		"A file containing a Slack bot token, to post notices to --slack-channel and thread later ones under the first",
+	)
+	flagSet.StringVar(
+		&ret.slackChannel,
+		"slack-channel",
+		"",
+		"Slack channel for --slack-token-file, e.g. #maintenance or C0123456789",
+	)
+	flagSet.StringVar(
+		&ret.notifyLedgerPath,
+		"notify-ledger-path",
+		"",
+		"File recording which notices have been sent, so each is sent once (required with --webhook-url and --slack-*)",
+	)
+	flagSet.StringVar(
+		&ret.hookCommand,
+		"hook-command",
+		"",
+		"Shell command to run when a maintenance event first appears, and at each --hook-lead-times before it starts",
+	)
+	hookLeadTimes := flagSet.String(
+		"hook-lead-times",
+		"",
+		"Comma-separated times before an event starts to run --hook-command again, e.g. '24h,1h'",
+	)
+	flagSet.DurationVar(
+		&ret.hookTimeout,
+		"hook-timeout",
+		DEFAULT_HOOK_TIMEOUT,
+		"Kill --hook-command if it runs longer than this",
+	)
+	flagSet.StringVar(
+		&ret.hookStatePath,
+		"hook-state-path",
+		"",
+		"File recording which hooks have run, so each runs once per event (required with --hook-command)",
+	)
+	instanceTags := flagSet.String(
+		"instance-tags",
+		"",
+		"Comma-separated instance tag keys to add as labels on aws_instance_info (needs instance metadata tags enabled)",
+	)
+	flagSet.DurationVar(
+		&ret.connectTimeout,
+		"connect-timeout",
+		DEFAULT_CONNECT_TIMEOUT,
+		"How long to wait to connect to the meta-data service",
+	)
+	flagSet.DurationVar(
+		&ret.requestTimeout,
+		"request-timeout",
+		DEFAULT_REQUEST_TIMEOUT,
+		"How long to wait for each meta-data request, start to finish",
+	)
+	flagSet.IntVar(
+		&ret.retries,
+		"retries",
+		DEFAULT_RETRIES,
+		"How many times to retry a meta-data request after a connection error, timeout, 429 or 5xx",
+	)
+	flagSet.StringVar(
+		&ret.imdsVersion,
+		"imds-version",
+		IMDS_VERSION_AUTO,
+		"'v2' to require an IMDSv2 token, 'v1' to never request one, or 'auto' to fall back to v1 when v2 is unavailable",
+	)
+	flagSet.StringVar(
+		&ret.listenAddress,
+		"listen-address",
+		DEFAULT_LISTEN_ADDRESS,
+		"With serve, the address to serve /metrics and /healthz on",
+	)
+	flagSet.StringVar(
+		&ret.tlsCertFile,
+		"tls-cert-file",
+		"",
+		"With serve, a PEM certificate file; serve HTTPS instead of HTTP",
+	)
+	flagSet.StringVar(
+		&ret.tlsKeyFile,
+		"tls-key-file",
+		"",
+		"With serve, the PEM private key file for --tls-cert-file",
+	)
+	flagSet.StringVar(
+		&ret.basicAuthUser,
+		"basic-auth-user",
+		"",
+		"With serve, require HTTP basic auth on /metrics with this user name",
+	)
+	flagSet.StringVar(
+		&ret.basicAuthPasswordFile,
+		"basic-auth-password-file",
+		"",
+		"With serve, a file containing the password for --basic-auth-user",
 	)
 	flagSet.Parse(args)
 
@@ -238,13 +891,164 @@ func parseArgs(args []string) (*collect_options, error) {
 		return &ret, errShowVersion
 	}
 
-	if len(ret.textfilesPath) == 0 {
+	if ret.command == COMMAND_COLLECT && len(ret.textfilesPath) == 0 && len(ret.output) == 0 {
 		return &ret, errMissingTextfilesPath
 	}
 
+	err := validateMetricPrefix(ret.metricPrefix, ret.format)
+	if err != nil {
+		return &ret, err
+	}
+
+	ret.fileMode, err = parseFileMode(*fileMode)
+	if err != nil {
+		return &ret, err
+	}
+
+	ret.fileUID, ret.fileGID, err = parseFileOwner(*fileOwner)
+	if err != nil {
+		return &ret, err
+	}
+
+	labelNames := map[string]bool{}
+	for _, key := range strings.Split(*instanceTags, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if labelNames[tagLabelName(key)] {
+			return &ret, fmt.Errorf("%w: %s", errDuplicateTagLabel, tagLabelName(key))
+		}
+		labelNames[tagLabelName(key)] = true
+		ret.instanceTags = append(ret.instanceTags, key)
+	}
+
+	if (ret.tlsCertFile == "") != (ret.tlsKeyFile == "") {
+		return &ret, errIncompleteTLS
+	}
+
+	if (ret.basicAuthUser == "") != (ret.basicAuthPasswordFile == "") {
+		return &ret, errIncompleteBasicAuth
+	}
+
+	if ret.interval <= 0 {
+		return &ret, errInvalidInterval
+	}
+
+	if ret.jitter < 0 {
+		return &ret, errInvalidJitter
+	}
+
+	if ret.connectTimeout <= 0 || ret.requestTimeout <= 0 {
+		return &ret, errInvalidTimeout
+	}
+
+	if ret.retries < 0 {
+		return &ret, errInvalidRetries
+	}
+
+	if !slices.Contains([]string{METRICS_SCHEMA_V1, METRICS_SCHEMA_V2}, ret.metricsSchema) {
+		return &ret, errInvalidMetricsSchema
+	}
+
+	if !slices.Contains([]string{FORMAT_PROMETHEUS, FORMAT_OPENMETRICS, FORMAT_JSON}, ret.format) {
+		return &ret, errInvalidFormat
+	}
+
+	if !slices.Contains([]string{IMDS_VERSION_AUTO, IMDS_VERSION_V1, IMDS_VERSION_V2}, ret.imdsVersion) {
+		return &ret, errInvalidIMDSVersion
+	}
+
+	if ret.tokenTTL < MIN_TOKEN_TTL || ret.tokenTTL > MAX_TOKEN_TTL || ret.tokenTTL%time.Second != 0 {
+		return &ret, errInvalidTokenTTL
+	}
+
+	if ret.checkCritical <= 0 || ret.checkWarning < ret.checkCritical {
+		return &ret, errInvalidCheckThresholds
+	}
+
+	ret.hookLeadTimes, err = parseLeadTimes(*hookLeadTimes)
+	if err != nil {
+		return &ret, err
+	}
+	if ret.hookTimeout <= 0 {
+		return &ret, errInvalidHookTimeout
+	}
+	if ret.hookCommand != "" && ret.hookStatePath == "" {
+		return &ret, errHookStatePathRequired
+	}
+	if (ret.slackTokenFile == "") != (ret.slackChannel == "") {
+		return &ret, errSlackChannelRequired
+	}
+	if ret.slackWebhookURL != "" && ret.slackWebhookURLFile != "" {
+		return &ret, errSlackWebhookURLTwice
+	}
+	slackWebhook := ret.slackWebhookURL != "" || ret.slackWebhookURLFile != ""
+	if slackWebhook && ret.slackTokenFile != "" {
+		return &ret, errSlackWebhookOrToken
+	}
+	notifying := ret.webhookURL != "" || slackWebhook || ret.slackTokenFile != ""
+	if notifying && ret.notifyLedgerPath == "" {
+		return &ret, errNotifyLedgerPathRequired
+	}
+
+	setFlags := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	err = resolveEndpoint(&ret, setFlags["base-url"], setFlags["endpoint-mode"])
+	if err != nil {
+		return &ret, err
+	}
+
 	return &ret, nil
 }
 
+// write the metadata in --format
+func writeOutput(writer io.Writer, metadata *fetched_metadata, opt *collect_options) error {
+	if opt.format == FORMAT_JSON {
+		return writeJSON(writer, metadata)
+	}
+	return writeMetrics(writer, metadata, opt.metricPrefix, opt.metricsSchema, opt.format)
+}
+
+// fetch metadata once and (atomically) write it to the textfile in opt.textfilesPath; canceling ctx
+// stops a hook that is running
+func collectOnce(ctx context.Context, opt *collect_options) error {
+	fetchedMetadata, err := fetchMetadata(opt)
+	if err != nil {
+		return err
+	}
+
+	if _, err := trackEvents(opt, fetchedMetadata); err != nil {
+		printError(err) // still write the metrics, without the change counters
+	}
+
+	if opt.output == "-" {
+		err = writeOutput(os.Stdout, fetchedMetadata, opt)
+		if err != nil {
+			return err
+		}
+	} else {
+		path := opt.output
+		if path == "" {
+			path = filepath.Join(opt.textfilesPath, textfileName(opt.format))
+		}
+		err = writeFileAtomic(path, opt.fileMode, opt.fileUID, opt.fileGID, func(w io.Writer) error {
+			return writeOutput(w, fetchedMetadata, opt)
+		})
+		if err != nil {
+			return err
+		}
+
+		okMessage := fmt.Sprintf("Wrote %s", path)
+		printInfo(okMessage)
+	}
+
+	// after writing, so a slow notifier or hook doesn't hold up the metrics
+	notifyErr := runNotifiers(opt, fetchedMetadata)
+	hookErr := runHooks(ctx, opt, fetchedMetadata)
+	return errors.Join(notifyErr, hookErr)
+}
+
 func main() {
 	opt, err := parseArgs(os.Args[1:])
 	if errors.Is(err, errShowVersion) {
@@ -256,19 +1060,43 @@ func main() {
 		osExit(0)
 		return // reachable in a test
 	}
+	if err != nil && opt.command == COMMAND_CHECK {
+		osExit(writeCheckUnknown(os.Stdout, err)) // a plugin reports its own problems as UNKNOWN
+		return
+	}
 	check(err)
 
-	fetchedMetadata, err := fetchMetadata(opt)
-	check(err)
+	imdsHTTPClient = newIMDSHTTPClient(opt)
 
-	created, err := os.Create(opt.textfilesPath + "/collect-aws-metadata.prom")
-	check(err)
-	fWriter := os.NewFile(created.Fd(), created.Name())
+	if opt.command == COMMAND_CHECK {
+		osExit(runCheck(os.Stdout, opt))
+		return
+	}
 
-	err = writeMetrics(fWriter, fetchedMetadata, opt.metricPrefix)
-	check(err)
-	fWriter.Close()
+	if opt.command == COMMAND_SHOW {
+		pending, err := runShow(os.Stdout, opt)
+		check(err)
+		if pending {
+			osExit(SHOW_EXIT_PENDING)
+			return
+		}
+		osExit(SHOW_EXIT_NOTHING_PENDING)
+		return
+	}
+
+	if opt.command == COMMAND_SERVE {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		check(runServer(ctx, opt))
+		return
+	}
+
+	if opt.daemon {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		runDaemon(ctx, opt, collectOnce)
+		return
+	}
 
-	okMessage := fmt.Sprintf("Wrote %s", created.Name())
-	printInfo(okMessage)
+	check(collectOnce(context.Background(), opt))
 }
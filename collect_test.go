@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 // create & return a replacement for Fatalf that collects calls to Fatalf
@@ -107,11 +108,14 @@ func Test_writeMetrics(t *testing.T) {
 		writer   *bytes.Buffer
 		metadata *fetched_metadata
 		prefix   string
+		schema   string
+		format   string
 	}
 	tests := []struct {
 		name    string
 		args    args
 		want    string
+		wantNot string // if set, must not match
 		wantErr bool
 	}{
 		{name: "none events",
@@ -119,7 +123,7 @@ func Test_writeMetrics(t *testing.T) {
 				writer:   bytes.NewBufferString(""),
 				metadata: &fetched_metadata{},
 				prefix:   "hi_"},
-			want:    `(?s)^hi_aws_maintenance_event_count\{cloud_instance=""\} 0$`,
+			want:    `(?m)^hi_aws_maintenance_event_count\{cloud_instance=""\} 0$`,
 			wantErr: false,
 		},
 		{name: "2x events",
@@ -136,24 +140,321 @@ func Test_writeMetrics(t *testing.T) {
 							Code:      "system-reboot",
 							NotBefore: "20 Jan 2019 09:00:43 GMT",
 						}}},
+				prefix: "",
+				schema: METRICS_SCHEMA_V1},
+			want:    `(?sm)cloud_instance="q-qqqqqq".*\b2\b.*\bevent_id="ev-ent1".*\b1579510843\b.*\bevent_id="ev-ent2".*\b1547974843$`,
+			wantErr: false,
+		},
+		{name: "v2 events",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					events: []maintenance_event{{
+						EventId:   "ev-ent1",
+						Code:      "system-reboot",
+						State:     "active",
+						NotBefore: "20 Jan 2020 09:00:43 GMT",
+						NotAfter:  "20 Jan 2020 11:00:43 GMT",
+					}}},
+				prefix: "",
+				schema: METRICS_SCHEMA_V2},
+			want: `(?sm)^aws_maintenance_event_not_before_timestamp_seconds\{cloud_instance="q-qqqqqq",event_code="system-reboot",event_id="ev-ent1",event_state="active"\} 1579510843$` +
+				`.*^aws_maintenance_event_not_after_timestamp_seconds\{cloud_instance="q-qqqqqq",event_code="system-reboot",event_id="ev-ent1",event_state="active"\} 1579518043$` +
+				`.*^aws_maintenance_event_window_seconds\{cloud_instance="q-qqqqqq",event_code="system-reboot",event_id="ev-ent1",event_state="active"\} 7200$` +
+				`.*^aws_maintenance_event_until_start_seconds\{cloud_instance="q-qqqqqq",event_code="system-reboot",event_id="ev-ent1",event_state="active"\} -\d+$` +
+				`.*^aws_maintenance_event_in_window\{cloud_instance="q-qqqqqq",event_code="system-reboot",event_id="ev-ent1",event_state="active"\} 0$`,
+			wantErr: false,
+		},
+		{name: "window active",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					events: []maintenance_event{{
+						EventId:   "ev-ent1",
+						State:     "active",
+						NotBefore: time.Now().Add(-time.Hour).UTC().Format(AWS_EVENT_TIME_FORMAT),
+						NotAfter:  time.Now().Add(time.Hour).UTC().Format(AWS_EVENT_TIME_FORMAT),
+					}}},
+				prefix: "",
+				schema: METRICS_SCHEMA_V2},
+			want: `(?sm)^aws_maintenance_window_active\{cloud_instance="q-qqqqqq"\} 1$` +
+				`.*^aws_maintenance_event_in_window\{cloud_instance="q-qqqqqq",event_code="",event_id="ev-ent1",event_state="active"\} 1$`,
+			wantErr: false,
+		},
+		{name: "window not active",
+			args: args{
+				writer:   bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq"},
+				prefix:   "",
+				schema:   METRICS_SCHEMA_V1},
+			want:    `(?m)^aws_maintenance_window_active\{cloud_instance="q-qqqqqq"\} 0$`,
+			wantErr: false,
+		},
+		{name: "v2 has no date labels",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					events: []maintenance_event{{EventId: "ev-ent1", NotBefore: "20 Jan 2020 09:00:43 GMT"}}},
+				prefix: "",
+				schema: METRICS_SCHEMA_V2},
+			want:    `aws_maintenance_event_not_before_timestamp_seconds`,
+			wantNot: `days_hence|event_date`,
+			wantErr: false,
+		},
+		{name: "v2 bad NotAfter",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					events: []maintenance_event{{EventId: "ev-ent1", NotBefore: "20 Jan 2020 09:00:43 GMT", NotAfter: "later"}}},
+				schema: METRICS_SCHEMA_V2},
+			wantErr: true,
+		},
+		{name: "v1 bad NotBefore",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					events: []maintenance_event{{EventId: "ev-ent1", NotBefore: "2020-01-20"}}},
+				schema: METRICS_SCHEMA_V1},
+			wantErr: true,
+		},
+		{name: "no spot action",
+			args: args{
+				writer:   bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq"},
+				prefix:   ""},
+			want:    `(?m)^aws_spot_instance_action_count\{cloud_instance="q-qqqqqq"\} 0$`,
+			wantErr: false,
+		},
+		{name: "spot action",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					spotAction: &spot_instance_action{Action: "terminate", Time: "2017-09-18T08:22:00Z"}},
+				prefix: ""},
+			want:    `(?sm)^aws_spot_instance_action_count\{cloud_instance="q-qqqqqq"\} 1$.*^aws_spot_instance_action\{cloud_instance="q-qqqqqq",action="terminate"\} 1505722920$`,
+			wantErr: false,
+		},
+		{name: "rebalance recommendation",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					rebalance: &rebalance_recommendation{NoticeTime: "2020-10-27T08:22:00Z"}},
+				prefix: "hi_"},
+			want:    `(?m)^hi_aws_rebalance_recommendation_timestamp\{cloud_instance="q-qqqqqq"\} 1603786920$`,
+			wantErr: false,
+		},
+		{name: "bad rebalance notice time",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					rebalance: &rebalance_recommendation{NoticeTime: "2020/10/27"}},
 				prefix: ""},
-			want:    `(?s)cloud_instance="q-qqqqqq".*\b2\b.*\bevent_id="ev-ent1".*\b1579510843\b.*\bevent_id="ev-ent2".*\b1547974843$`,
+			wantErr: true,
+		},
+		{name: "autoscaling lifecycle state",
+			args: args{
+				writer:   bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq", lifecycleState: "Warmed:Stopped"},
+				prefix:   ""},
+			want:    `(?sm)^aws_autoscaling_target_lifecycle_state\{cloud_instance="q-qqqqqq",state="InService"\} 0$.*^aws_autoscaling_target_lifecycle_state\{cloud_instance="q-qqqqqq",state="Warmed:Stopped"\} 1$`,
 			wantErr: false,
 		},
+		{name: "unknown autoscaling lifecycle state",
+			args: args{
+				writer:   bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq", lifecycleState: "Pending:Wait"},
+				prefix:   ""},
+			want:    `(?m)^aws_autoscaling_target_lifecycle_state\{cloud_instance="q-qqqqqq",state="Pending:Wait"\} 1$`,
+			wantErr: false,
+		},
+		{name: "instance info",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					identity: instance_identity{
+						AccountId:        "123456789012",
+						AvailabilityZone: "us-east-1a",
+						ImageId:          "ami-0abcdef1234567890",
+						InstanceType:     "m5.large",
+						Region:           "us-east-1",
+					},
+					lifeCycle: "spot"},
+				prefix: "hi_"},
+			want:    `(?m)^hi_aws_instance_info\{cloud_instance="q-qqqqqq",instance_type="m5.large",availability_zone="us-east-1a",region="us-east-1",ami_id="ami-0abcdef1234567890",instance_life_cycle="spot",account_id="123456789012"\} 1$`,
+			wantErr: false,
+		},
+		{name: "imds version",
+			args: args{
+				writer:   bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq", imdsVersion: 1},
+				prefix:   "hi_"},
+			want:    `(?m)^hi_aws_imds_version_used\{cloud_instance="q-qqqqqq"\} 1$`,
+			wantErr: false,
+		},
+		{name: "instance tags",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					tags: []instance_tag{{key: "cluster", value: `say "hi"`}, {key: "team-name", value: ""}}},
+				prefix: ""},
+			want:    `(?m)^aws_instance_info\{.*account_id="",tag_cluster="say \\"hi\\"",tag_team_name=""\} 1$`,
+			wantErr: false,
+		},
+		{name: "help and type lines",
+			args: args{
+				writer:   bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq"},
+				prefix:   "hi_"},
+			want:    `(?m)^# HELP hi_aws_maintenance_event_count .+\n# TYPE hi_aws_maintenance_event_count gauge\nhi_aws_maintenance_event_count\{cloud_instance="q-qqqqqq"\} 0$`,
+			wantNot: `aws_spot_instance_action\b|aws_rebalance_recommendation_timestamp`, // no samples, no HELP/TYPE either
+			wantErr: false,
+		},
+		{name: "label values are escaped",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					events: []maintenance_event{{EventId: "ev-\"1\"\n", Code: `a\b`, NotBefore: "20 Jan 2020 09:00:43 GMT"}}},
+				schema: METRICS_SCHEMA_V2},
+			want:    `(?m)^aws_maintenance_event_not_before_timestamp_seconds\{cloud_instance="q-qqqqqq",event_code="a\\\\b",event_id="ev-\\"1\\"\\n",event_state=""\} 1579510843$`,
+			wantErr: false,
+		},
+		{name: "each family is written together",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					events: []maintenance_event{
+						{EventId: "ev-ent2", NotBefore: "20 Jan 2020 09:00:43 GMT"},
+						{EventId: "ev-ent1", NotBefore: "20 Jan 2019 09:00:43 GMT"},
+					}},
+				schema: METRICS_SCHEMA_V2},
+			want: `(?m)^aws_maintenance_event_not_before_timestamp_seconds\{.*event_id="ev-ent1".*\} 1547974843\n` +
+				`aws_maintenance_event_not_before_timestamp_seconds\{.*event_id="ev-ent2".*\} 1579510843\n# HELP`,
+			wantErr: false,
+		},
+		{name: "event state sets",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					events: []maintenance_event{{EventId: "ev-ent1", Code: "system-reboot", State: "active", NotBefore: "20 Jan 2020 09:00:43 GMT"}}},
+				schema: METRICS_SCHEMA_V2},
+			want: `(?sm)^# TYPE aws_maintenance_event_state gauge$` +
+				`.*^aws_maintenance_event_state\{cloud_instance="q-qqqqqq",event_id="ev-ent1",event_state="active"\} 1$` +
+				`.*^aws_maintenance_event_state\{cloud_instance="q-qqqqqq",event_id="ev-ent1",event_state="canceled"\} 0$` +
+				`.*^aws_maintenance_event_code\{cloud_instance="q-qqqqqq",event_id="ev-ent1",event_code="instance-reboot"\} 0$` +
+				`.*^aws_maintenance_event_code\{cloud_instance="q-qqqqqq",event_id="ev-ent1",event_code="system-reboot"\} 1$`,
+			wantNot: `(?m)^# (UNIT|EOF)`,
+			wantErr: false,
+		},
+		{name: "openmetrics",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq", lifecycleState: "InService",
+					events: []maintenance_event{{EventId: "ev-ent1", Code: "new-code", State: "active", NotBefore: "20 Jan 2020 09:00:43 GMT"}}},
+				prefix: "hi_",
+				schema: METRICS_SCHEMA_V2,
+				format: FORMAT_OPENMETRICS},
+			want: `(?sm)^# HELP hi_aws_instance .*\n# TYPE hi_aws_instance info\nhi_aws_instance_info\{cloud_instance="q-qqqqqq",.*\} 1$` +
+				`.*^# TYPE hi_aws_maintenance_event_not_before_timestamp_seconds gauge\n# UNIT hi_aws_maintenance_event_not_before_timestamp_seconds seconds$` +
+				`.*^# TYPE hi_aws_maintenance_event_code stateset$` +
+				`.*^hi_aws_maintenance_event_code\{cloud_instance="q-qqqqqq",event_id="ev-ent1",hi_aws_maintenance_event_code="new-code"\} 1$` +
+				`.*^hi_aws_autoscaling_target_lifecycle_state\{cloud_instance="q-qqqqqq",hi_aws_autoscaling_target_lifecycle_state="InService"\} 1$` +
+				`.*\n# EOF$`,
+			wantErr: false,
+		},
+		{name: "event change counters",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					eventChanges: map[string]int64{CHANGE_NEW: 3, CHANGE_VANISHED: 1}},
+				format: FORMAT_OPENMETRICS},
+			want: `(?sm)^# TYPE aws_maintenance_event_changes counter$` +
+				`.*^aws_maintenance_event_changes_total\{cloud_instance="q-qqqqqq",change="new"\} 3$` +
+				`.*^aws_maintenance_event_changes_total\{cloud_instance="q-qqqqqq",change="rescheduled"\} 0$` +
+				`.*^aws_maintenance_event_changes_total\{cloud_instance="q-qqqqqq",change="vanished"\} 1$`,
+			wantErr: false,
+		},
+		{name: "no event change counters without a state file",
+			args: args{
+				writer:   bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq"}},
+			want:    `aws_maintenance_event_count`,
+			wantNot: `aws_maintenance_event_changes_total`,
+			wantErr: false,
+		},
+		{name: "bad spot action time",
+			args: args{
+				writer: bytes.NewBufferString(""),
+				metadata: &fetched_metadata{instanceID: "q-qqqqqq",
+					spotAction: &spot_instance_action{Action: "terminate", Time: "soon"}},
+				prefix: ""},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := writeMetrics(tt.args.writer, tt.args.metadata, tt.args.prefix)
+			err := writeMetrics(tt.args.writer, tt.args.metadata, tt.args.prefix, tt.args.schema, tt.args.format)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("writeMetrics() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if tt.wantErr {
+				return
+			}
 			bb, _ := io.ReadAll(tt.args.writer)
 			trimmed := strings.TrimSpace(string(bb))
 			rx := regexp.MustCompile(tt.want)
 			if rx.FindStringIndex(trimmed) == nil {
 				t.Errorf("got %s, != %s", trimmed, tt.want)
 			}
+			if tt.wantNot != "" && regexp.MustCompile(tt.wantNot).MatchString(trimmed) {
+				t.Errorf("got %s, matches %s", trimmed, tt.wantNot)
+			}
+		})
+	}
+}
+
+func Test_inEventWindow(t *testing.T) {
+	now := time.Date(2020, 1, 20, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		ev      maintenance_event
+		want    bool
+		wantErr bool
+	}{
+		{name: "before",
+			ev:   maintenance_event{State: "active", NotBefore: "20 Jan 2020 11:00:00 GMT", NotAfter: "20 Jan 2020 12:00:00 GMT"},
+			want: false},
+		{name: "during",
+			ev:   maintenance_event{State: "active", NotBefore: "20 Jan 2020 09:00:00 GMT", NotAfter: "20 Jan 2020 11:00:00 GMT"},
+			want: true},
+		{name: "starts now",
+			ev:   maintenance_event{State: "active", NotBefore: "20 Jan 2020 10:00:00 GMT", NotAfter: "20 Jan 2020 11:00:00 GMT"},
+			want: true},
+		{name: "after",
+			ev:   maintenance_event{State: "active", NotBefore: "20 Jan 2020 08:00:00 GMT", NotAfter: "20 Jan 2020 09:00:00 GMT"},
+			want: false},
+		{name: "started, no NotAfter",
+			ev:   maintenance_event{State: "active", NotBefore: "20 Jan 2020 09:00:00 GMT"},
+			want: true},
+		{name: "completed",
+			ev:   maintenance_event{State: "completed", NotBefore: "20 Jan 2020 09:00:00 GMT", NotAfter: "20 Jan 2020 11:00:00 GMT"},
+			want: false},
+		{name: "canceled",
+			ev:   maintenance_event{State: "canceled", NotBefore: "20 Jan 2020 09:00:00 GMT"},
+			want: false},
+		{name: "bad NotAfter",
+			ev:      maintenance_event{State: "active", NotBefore: "20 Jan 2020 09:00:00 GMT", NotAfter: "tomorrow"},
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := inEventWindow(tt.ev, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("inEventWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("inEventWindow() = %v, want %v", got, tt.want)
+			}
 		})
 	}
 }
@@ -237,6 +538,14 @@ type writerFunc func(w http.ResponseWriter)
 //
 // Returns the server with these handlers bound to write responses
 func helpMakeAServer(fnID writerFunc, fnJSON writerFunc) *httptest.Server {
+	return helpMakeAServerWithRoutes(map[string]writerFunc{
+		DEFAULT_INSTANCE_ID_PATH: fnID,
+		DEFAULT_SCHEDULED_PATH:   fnJSON,
+	})
+}
+
+// like helpMakeAServer, for any set of meta-data paths. Paths not in `routes` are 404, like IMDS.
+func helpMakeAServerWithRoutes(routes map[string]writerFunc) *httptest.Server {
 	// Track if we've received a valid token
 	var validToken string
 
@@ -265,10 +574,10 @@ func helpMakeAServer(fnID writerFunc, fnJSON writerFunc) *httptest.Server {
 				return
 			}
 
-			if strings.HasSuffix(r.URL.String(), "/instance-id") {
-				fnID(w)
+			if fn, ok := routes[r.URL.Path]; ok {
+				fn(w)
 			} else {
-				fnJSON(w)
+				http.NotFound(w, r)
 			}
 		}))
 }
@@ -302,8 +611,9 @@ func Test_fetchMetadata(t *testing.T) {
 				},
 			),
 			want: fetched_metadata{
-				instanceID: "i-jklmn",
-				events:     mevs},
+				instanceID:  "i-jklmn",
+				events:      mevs,
+				imdsVersion: 2},
 			wantErr: false},
 		{name: "bad instance-id",
 			server: helpMakeAServer(
@@ -351,6 +661,351 @@ func Test_fetchMetadata(t *testing.T) {
 	}
 }
 
+func Test_fetchMetadata_spotAction(t *testing.T) {
+	routes := func(spot writerFunc) map[string]writerFunc {
+		return map[string]writerFunc{
+			DEFAULT_INSTANCE_ID_PATH: func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+			DEFAULT_SCHEDULED_PATH:   func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+			DEFAULT_SPOT_ACTION_PATH: spot,
+		}
+	}
+	tests := []struct {
+		name    string
+		server  *httptest.Server
+		want    *spot_instance_action
+		wantErr bool
+	}{
+		{name: "pending action",
+			server: helpMakeAServerWithRoutes(routes(func(w http.ResponseWriter) {
+				fmt.Fprint(w, `{"action": "terminate", "time": "2017-09-18T08:22:00Z"}`)
+			})),
+			want: &spot_instance_action{Action: "terminate", Time: "2017-09-18T08:22:00Z"}},
+		{name: "404 is no notice",
+			server: helpMakeAServer(
+				func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+				func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+			),
+			want: nil},
+		{name: "500 is an error",
+			server: helpMakeAServerWithRoutes(routes(func(w http.ResponseWriter) {
+				http.Error(w, "oops", 500)
+			})),
+			wantErr: true},
+		{name: "bad JSON",
+			server: helpMakeAServerWithRoutes(routes(func(w http.ResponseWriter) {
+				fmt.Fprint(w, "terminate")
+			})),
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.server.Close()
+			got, err := fetchMetadata(&collect_options{baseURL: tt.server.URL})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got.spotAction, tt.want) {
+				t.Errorf("fetchMetadata().spotAction = %v, want %v", got.spotAction, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fetchMetadata_rebalance(t *testing.T) {
+	routes := func(rebalance writerFunc) map[string]writerFunc {
+		return map[string]writerFunc{
+			DEFAULT_INSTANCE_ID_PATH: func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+			DEFAULT_SCHEDULED_PATH:   func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+			DEFAULT_REBALANCE_PATH:   rebalance,
+		}
+	}
+	tests := []struct {
+		name    string
+		server  *httptest.Server
+		want    *rebalance_recommendation
+		wantErr bool
+	}{
+		{name: "recommended",
+			server: helpMakeAServerWithRoutes(routes(func(w http.ResponseWriter) {
+				fmt.Fprint(w, `{"noticeTime": "2020-10-27T08:22:00Z"}`)
+			})),
+			want: &rebalance_recommendation{NoticeTime: "2020-10-27T08:22:00Z"}},
+		{name: "404 is no recommendation",
+			server: helpMakeAServer(
+				func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+				func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+			),
+			want: nil},
+		{name: "bad JSON",
+			server: helpMakeAServerWithRoutes(routes(func(w http.ResponseWriter) {
+				fmt.Fprint(w, "<html>")
+			})),
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.server.Close()
+			got, err := fetchMetadata(&collect_options{baseURL: tt.server.URL})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got.rebalance, tt.want) {
+				t.Errorf("fetchMetadata().rebalance = %v, want %v", got.rebalance, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fetchMetadata_autoscaling(t *testing.T) {
+	stateRequests := 0
+	routes := map[string]writerFunc{
+		DEFAULT_INSTANCE_ID_PATH: func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+		DEFAULT_SCHEDULED_PATH:   func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+		DEFAULT_AUTOSCALING_STATE_PATH: func(w http.ResponseWriter) {
+			stateRequests++
+			fmt.Fprint(w, "InService")
+		},
+	}
+	tests := []struct {
+		name         string
+		server       *httptest.Server
+		autoscaling  bool
+		want         string
+		wantRequests int
+	}{
+		{name: "in an ASG",
+			server:       helpMakeAServerWithRoutes(routes),
+			autoscaling:  true,
+			want:         "InService",
+			wantRequests: 1},
+		{name: "flag off makes no request",
+			server:       helpMakeAServerWithRoutes(routes),
+			autoscaling:  false,
+			want:         "",
+			wantRequests: 0},
+		{name: "404 when not in an ASG",
+			server: helpMakeAServer(
+				func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+				func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+			),
+			autoscaling:  true,
+			want:         "",
+			wantRequests: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.server.Close()
+			stateRequests = 0
+			got, err := fetchMetadata(&collect_options{baseURL: tt.server.URL, autoscaling: tt.autoscaling})
+			if err != nil {
+				t.Fatalf("fetchMetadata() error = %v", err)
+			}
+			if got.lifecycleState != tt.want {
+				t.Errorf("fetchMetadata().lifecycleState = %q, want %q", got.lifecycleState, tt.want)
+			}
+			if stateRequests != tt.wantRequests {
+				t.Errorf("fetchMetadata() requested the lifecycle state %d times, want %d", stateRequests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func Test_fetchMetadata_instanceInfo(t *testing.T) {
+	routes := func(identity writerFunc) map[string]writerFunc {
+		return map[string]writerFunc{
+			DEFAULT_INSTANCE_ID_PATH:       func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+			DEFAULT_SCHEDULED_PATH:         func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+			DEFAULT_IDENTITY_DOCUMENT_PATH: identity,
+			DEFAULT_LIFE_CYCLE_PATH:        func(w http.ResponseWriter) { fmt.Fprint(w, "on-demand") },
+		}
+	}
+	tests := []struct {
+		name          string
+		server        *httptest.Server
+		wantIdentity  instance_identity
+		wantLifeCycle string
+		wantErr       bool
+	}{
+		{name: "identity document",
+			server: helpMakeAServerWithRoutes(routes(func(w http.ResponseWriter) {
+				fmt.Fprint(w, `{"accountId": "123456789012", "availabilityZone": "us-east-1a", "imageId": "ami-0abc",
+					"instanceId": "i-jklmn", "instanceType": "m5.large", "region": "us-east-1", "version": "2017-09-30"}`)
+			})),
+			wantIdentity: instance_identity{
+				AccountId:        "123456789012",
+				AvailabilityZone: "us-east-1a",
+				ImageId:          "ami-0abc",
+				InstanceType:     "m5.large",
+				Region:           "us-east-1",
+			},
+			wantLifeCycle: "on-demand"},
+		{name: "404s leave the labels blank",
+			server: helpMakeAServer(
+				func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+				func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+			)},
+		{name: "bad JSON",
+			server: helpMakeAServerWithRoutes(routes(func(w http.ResponseWriter) {
+				fmt.Fprint(w, "us-east-1a")
+			})),
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.server.Close()
+			got, err := fetchMetadata(&collect_options{baseURL: tt.server.URL})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchMetadata() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.identity != tt.wantIdentity {
+				t.Errorf("fetchMetadata().identity = %v, want %v", got.identity, tt.wantIdentity)
+			}
+			if got.lifeCycle != tt.wantLifeCycle {
+				t.Errorf("fetchMetadata().lifeCycle = %q, want %q", got.lifeCycle, tt.wantLifeCycle)
+			}
+		})
+	}
+}
+
+func Test_fetchMetadata_instanceTags(t *testing.T) {
+	routes := map[string]writerFunc{
+		DEFAULT_INSTANCE_ID_PATH:                   func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+		DEFAULT_SCHEDULED_PATH:                     func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+		DEFAULT_TAGS_PATH:                          func(w http.ResponseWriter) { fmt.Fprint(w, "Name\ncluster\nteam name") },
+		DEFAULT_TAGS_PATH + "/cluster":             func(w http.ResponseWriter) { fmt.Fprint(w, "aero-1") },
+		DEFAULT_TAGS_PATH + "/Name":                func(w http.ResponseWriter) { fmt.Fprint(w, "not asked for") },
+		DEFAULT_TAGS_PATH + "/" + "team name":      func(w http.ResponseWriter) { fmt.Fprint(w, "dbaas") },
+		DEFAULT_TAGS_PATH + "/" + "not-in-listing": func(w http.ResponseWriter) { fmt.Fprint(w, "unreachable") },
+	}
+	tests := []struct {
+		name   string
+		server *httptest.Server
+		keys   []string
+		want   []instance_tag
+	}{
+		{name: "allowlisted tags",
+			server: helpMakeAServerWithRoutes(routes),
+			keys:   []string{"team name", "cluster", "missing"},
+			want:   []instance_tag{{"team name", "dbaas"}, {"cluster", "aero-1"}, {"missing", ""}}},
+		{name: "deleted after the listing",
+			server: helpMakeAServerWithRoutes(map[string]writerFunc{
+				DEFAULT_INSTANCE_ID_PATH:       routes[DEFAULT_INSTANCE_ID_PATH],
+				DEFAULT_SCHEDULED_PATH:         routes[DEFAULT_SCHEDULED_PATH],
+				DEFAULT_TAGS_PATH:              func(w http.ResponseWriter) { fmt.Fprint(w, "cluster\nteam") },
+				DEFAULT_TAGS_PATH + "/cluster": routes[DEFAULT_TAGS_PATH+"/cluster"],
+			}),
+			keys: []string{"cluster", "team"},
+			want: []instance_tag{{"cluster", "aero-1"}, {"team", ""}}},
+		{name: "no allowlist",
+			server: helpMakeAServerWithRoutes(routes),
+			keys:   nil,
+			want:   nil},
+		{name: "tags not enabled",
+			server: helpMakeAServer(
+				func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+				func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+			),
+			keys: []string{"cluster"},
+			want: []instance_tag{{"cluster", ""}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.server.Close()
+			got, err := fetchMetadata(&collect_options{baseURL: tt.server.URL, instanceTags: tt.keys})
+			if err != nil {
+				t.Fatalf("fetchMetadata() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.tags, tt.want) {
+				t.Errorf("fetchMetadata().tags = %v, want %v", got.tags, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tagLabelName(t *testing.T) {
+	tests := map[string]string{
+		"cluster":                       "tag_cluster",
+		"aws:cloudformation:stack-name": "tag_aws_cloudformation_stack_name",
+		"Team Name":                     "tag_Team_Name",
+		"9lives":                        "tag_9lives",
+	}
+	for key, want := range tests {
+		if got := tagLabelName(key); got != want {
+			t.Errorf("tagLabelName(%s) = %s, want %s", key, got, want)
+		}
+	}
+}
+
+func Test_fetchMetadata_cachedToken(t *testing.T) {
+	tokenRequests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/latest/api/token"):
+			tokenRequests++
+			fmt.Fprint(w, "test-token")
+		case strings.HasSuffix(r.URL.Path, "/instance-id"):
+			fmt.Fprint(w, "i-jklmn")
+		case r.URL.Path == DEFAULT_SCHEDULED_PATH:
+			fmt.Fprint(w, "[]")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	opts := collect_options{baseURL: srv.URL, tokenTTL: DEFAULT_TOKEN_TTL}
+	for i := 0; i < 3; i++ {
+		if _, err := fetchMetadata(&opts); err != nil {
+			t.Fatalf("fetchMetadata() error = %v", err)
+		}
+	}
+	if tokenRequests != 1 {
+		t.Errorf("fetchMetadata() requested a token %d times, want 1", tokenRequests)
+	}
+
+	// an expired token is replaced
+	opts.tokenExpires = time.Now().Add(-time.Second)
+	if _, err := fetchMetadata(&opts); err != nil {
+		t.Fatalf("fetchMetadata() error = %v", err)
+	}
+	if tokenRequests != 2 {
+		t.Errorf("fetchMetadata() requested a token %d times, want 2", tokenRequests)
+	}
+}
+
+// the options parseArgs returns for `--textfiles-path .` and nothing else, changed by `modify`
+func helpDefaultOptions(modify func(o *collect_options)) *collect_options {
+	o := &collect_options{
+		command:        COMMAND_COLLECT,
+		metricsSchema:  METRICS_SCHEMA_V2,
+		format:         FORMAT_PROMETHEUS,
+		checkWarning:   DEFAULT_CHECK_WARNING,
+		checkCritical:  DEFAULT_CHECK_CRITICAL,
+		hookTimeout:    DEFAULT_HOOK_TIMEOUT,
+		baseURL:        DEFAULT_BASE_URL,
+		textfilesPath:  ".",
+		interval:       DEFAULT_INTERVAL,
+		jitter:         DEFAULT_JITTER,
+		fileMode:       0644,
+		fileUID:        -1,
+		fileGID:        -1,
+		listenAddress:  DEFAULT_LISTEN_ADDRESS,
+		connectTimeout: DEFAULT_CONNECT_TIMEOUT,
+		requestTimeout: DEFAULT_REQUEST_TIMEOUT,
+		retries:        DEFAULT_RETRIES,
+		imdsVersion:    IMDS_VERSION_AUTO,
+		endpointMode:   ENDPOINT_MODE_IPV4,
+		tokenTTL:       DEFAULT_TOKEN_TTL,
+	}
+	if modify != nil {
+		modify(o)
+	}
+	return o
+}
+
 func Test_parseArgs(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -373,23 +1028,359 @@ func Test_parseArgs(t *testing.T) {
 		{
 			name: "options are set, default metricPrefix",
 			args: []string{"--textfiles-path", ".", "--base-url", "http://example.com"},
-			want: &collect_options{
-				baseURL:       "http://example.com",
-				metricPrefix:  "",
-				textfilesPath: ".",
-			},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.baseURL = "http://example.com"
+			}),
 			wantErr: nil,
 		},
 		{
 			name: "options are set, use default baseURL",
 			args: []string{"--textfiles-path", ".", "--metric-prefix", "asdf_"},
-			want: &collect_options{
-				baseURL:       "http://169.254.169.254",
-				metricPrefix:  "asdf_",
-				textfilesPath: ".",
-			},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.baseURL = "http://169.254.169.254"
+				o.metricPrefix = "asdf_"
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "daemon with interval and jitter",
+			args: []string{"--textfiles-path", ".", "--daemon", "--interval=1m", "--jitter=0s", "--autoscaling"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.daemon = true
+				o.autoscaling = true
+				o.interval = time.Minute
+				o.jitter = 0
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "serve does not need --textfiles-path",
+			args: []string{"serve", "--listen-address=127.0.0.1:9999"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.command = COMMAND_SERVE
+				o.textfilesPath = ""
+				o.listenAddress = "127.0.0.1:9999"
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "serve with a TLS cert but no key should error",
+			args:    []string{"serve", "--tls-cert-file=cert.pem"},
+			want:    nil,
+			wantErr: errIncompleteTLS,
+		},
+		{
+			name: "show does not need textfiles-path",
+			args: []string{"show"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.command = COMMAND_SHOW
+				o.textfilesPath = ""
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "check thresholds",
+			args: []string{"check", "--warning=48h", "--critical=2h"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.command = COMMAND_CHECK
+				o.textfilesPath = ""
+				o.checkWarning = 48 * time.Hour
+				o.checkCritical = 2 * time.Hour
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "hook options",
+			args: []string{"--textfiles-path", ".", "--hook-command=/usr/local/bin/drain", "--hook-state-path=/var/lib/x/hooks.json", "--hook-lead-times=1h,24h"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.hookCommand = "/usr/local/bin/drain"
+				o.hookStatePath = "/var/lib/x/hooks.json"
+				o.hookLeadTimes = []time.Duration{24 * time.Hour, time.Hour}
+			}),
 			wantErr: nil,
 		},
+		{
+			name: "webhook options",
+			args: []string{"--textfiles-path", ".", "--webhook-url=https://bot.example.com/hooks/aws", "--webhook-secret-file=/etc/x/secret", "--notify-ledger-path=/var/lib/x/notify.json"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.webhookURL = "https://bot.example.com/hooks/aws"
+				o.webhookSecretFile = "/etc/x/secret"
+				o.notifyLedgerPath = "/var/lib/x/notify.json"
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "state path",
+			args: []string{"--textfiles-path", ".", "--state-path=/var/lib/x/events.json"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.statePath = "/var/lib/x/events.json"
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "webhook without a ledger should error",
+			args:    []string{"--textfiles-path", ".", "--webhook-url=https://bot.example.com/hooks/aws"},
+			want:    nil,
+			wantErr: errNotifyLedgerPathRequired,
+		},
+		{
+			name: "slack options",
+			args: []string{"--textfiles-path", ".", "--slack-token-file=/etc/x/slack-token", "--slack-channel=#maintenance", "--notify-ledger-path=/var/lib/x/notify.json"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.slackTokenFile = "/etc/x/slack-token"
+				o.slackChannel = "#maintenance"
+				o.notifyLedgerPath = "/var/lib/x/notify.json"
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "slack webhook url file",
+			args: []string{"--textfiles-path", ".", "--slack-webhook-url-file=/etc/x/slack-webhook", "--notify-ledger-path=/var/lib/x/notify.json"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.slackWebhookURLFile = "/etc/x/slack-webhook"
+				o.notifyLedgerPath = "/var/lib/x/notify.json"
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "slack webhook url and file should error",
+			args:    []string{"--textfiles-path", ".", "--slack-webhook-url=https://hooks.slack.com/services/T0/B0/x", "--slack-webhook-url-file=/etc/x/slack-webhook", "--notify-ledger-path=/var/lib/x/notify.json"},
+			want:    nil,
+			wantErr: errSlackWebhookURLTwice,
+		},
+		{
+			name:    "slack webhook url file without a ledger should error",
+			args:    []string{"--textfiles-path", ".", "--slack-webhook-url-file=/etc/x/slack-webhook"},
+			want:    nil,
+			wantErr: errNotifyLedgerPathRequired,
+		},
+		{
+			name:    "slack without a ledger should error",
+			args:    []string{"--textfiles-path", ".", "--slack-webhook-url=https://hooks.slack.com/services/T0/B0/x"},
+			want:    nil,
+			wantErr: errNotifyLedgerPathRequired,
+		},
+		{
+			name:    "slack token without a channel should error",
+			args:    []string{"--textfiles-path", ".", "--slack-token-file=/etc/x/slack-token", "--notify-ledger-path=/var/lib/x/notify.json"},
+			want:    nil,
+			wantErr: errSlackChannelRequired,
+		},
+		{
+			name:    "slack webhook and token should error",
+			args:    []string{"--textfiles-path", ".", "--slack-webhook-url=https://hooks.slack.com/services/T0/B0/x", "--slack-token-file=/etc/x/slack-token", "--slack-channel=#maintenance", "--notify-ledger-path=/var/lib/x/notify.json"},
+			want:    nil,
+			wantErr: errSlackWebhookOrToken,
+		},
+		{
+			name:    "hook command without a state path should error",
+			args:    []string{"--textfiles-path", ".", "--hook-command=/usr/local/bin/drain"},
+			want:    nil,
+			wantErr: errHookStatePathRequired,
+		},
+		{
+			name:    "check critical longer than warning should error",
+			args:    []string{"check", "--warning=1h", "--critical=2h"},
+			want:    nil,
+			wantErr: errInvalidCheckThresholds,
+		},
+		{
+			name:    "serve with a basic auth user but no password should error",
+			args:    []string{"serve", "--basic-auth-user=prometheus"},
+			want:    nil,
+			wantErr: errIncompleteBasicAuth,
+		},
+		{
+			name: "file mode and owner",
+			args: []string{"--textfiles-path", ".", "--file-mode=0640", "--file-owner=65534:65533"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.fileMode = 0640
+				o.fileUID = 65534
+				o.fileGID = 65533
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "instance tags",
+			args: []string{"--textfiles-path", ".", "--instance-tags", "cluster, team,,"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.instanceTags = []string{"cluster", "team"}
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "instance tags with clashing label names should error",
+			args:    []string{"--textfiles-path", ".", "--instance-tags", "team-name,team.name"},
+			want:    nil,
+			wantErr: errDuplicateTagLabel,
+		},
+		{
+			name:    "non-octal file mode should error",
+			args:    []string{"--textfiles-path", ".", "--file-mode=rw-r--r--"},
+			want:    nil,
+			wantErr: errInvalidFileMode,
+		},
+		{
+			name: "legacy metrics schema",
+			args: []string{"--textfiles-path", ".", "--metrics-schema=v1"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.metricsSchema = METRICS_SCHEMA_V1
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "metric prefix with a dash should error",
+			args:    []string{"--textfiles-path", ".", "--metric-prefix=my-app_"},
+			want:    nil,
+			wantErr: errInvalidMetricPrefix,
+		},
+		{
+			name:    "metric prefix starting with a digit should error",
+			args:    []string{"--textfiles-path", ".", "--metric-prefix=1_"},
+			want:    nil,
+			wantErr: errInvalidMetricPrefix,
+		},
+		{
+			name:    "metric prefix with a colon should error with openmetrics",
+			args:    []string{"--textfiles-path", ".", "--metric-prefix=org:", "--format=openmetrics"},
+			want:    nil,
+			wantErr: errColonInOpenMetricsPrefix,
+		},
+		{
+			name: "metric prefix with a colon",
+			args: []string{"--textfiles-path", ".", "--metric-prefix=org:"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.metricPrefix = "org:"
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "openmetrics format",
+			args: []string{"--textfiles-path", ".", "--format=openmetrics"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.format = FORMAT_OPENMETRICS
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "output instead of textfiles-path",
+			args: []string{"--format=json", "--output=-"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.textfilesPath = ""
+				o.format = FORMAT_JSON
+				o.output = "-"
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "unknown format should error",
+			args:    []string{"--textfiles-path", ".", "--format=xml"},
+			want:    nil,
+			wantErr: errInvalidFormat,
+		},
+		{
+			name:    "unknown metrics schema should error",
+			args:    []string{"--textfiles-path", ".", "--metrics-schema=v3"},
+			want:    nil,
+			wantErr: errInvalidMetricsSchema,
+		},
+		{
+			name:    "zero interval should error",
+			args:    []string{"--textfiles-path", ".", "--interval=0s"},
+			want:    nil,
+			wantErr: errInvalidInterval,
+		},
+		{
+			name:    "negative jitter should error",
+			args:    []string{"--textfiles-path", ".", "--jitter=-1s"},
+			want:    nil,
+			wantErr: errInvalidJitter,
+		},
+		{
+			name: "timeouts and retries",
+			args: []string{"--textfiles-path", ".", "--connect-timeout=500ms", "--request-timeout=2s", "--retries=0"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.connectTimeout = 500 * time.Millisecond
+				o.requestTimeout = 2 * time.Second
+				o.retries = 0
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "zero timeout should error",
+			args:    []string{"--textfiles-path", ".", "--request-timeout=0s"},
+			want:    nil,
+			wantErr: errInvalidTimeout,
+		},
+		{
+			name: "imds version",
+			args: []string{"--textfiles-path", ".", "--imds-version=v2"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.imdsVersion = IMDS_VERSION_V2
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "unknown imds version should error",
+			args:    []string{"--textfiles-path", ".", "--imds-version=v3"},
+			want:    nil,
+			wantErr: errInvalidIMDSVersion,
+		},
+		{
+			name: "ipv6 endpoint",
+			args: []string{"--textfiles-path", ".", "--endpoint-mode=ipv6"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.endpointMode = ENDPOINT_MODE_IPV6
+				o.baseURL = "http://[fd00:ec2::254]"
+			}),
+			wantErr: nil,
+		},
+		{
+			name: "imds through a proxy",
+			args: []string{"--textfiles-path", ".", "--imds-use-proxy"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.imdsUseProxy = true
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "unknown endpoint mode should error",
+			args:    []string{"--textfiles-path", ".", "--endpoint-mode=ipx"},
+			want:    nil,
+			wantErr: errInvalidEndpointMode,
+		},
+		{
+			name: "token ttl",
+			args: []string{"--textfiles-path", ".", "--token-ttl=90s"},
+			want: helpDefaultOptions(func(o *collect_options) {
+				o.tokenTTL = 90 * time.Second
+			}),
+			wantErr: nil,
+		},
+		{
+			name:    "token ttl too long should error",
+			args:    []string{"--textfiles-path", ".", "--token-ttl=7h"},
+			want:    nil,
+			wantErr: errInvalidTokenTTL,
+		},
+		{
+			name:    "token ttl too short should error",
+			args:    []string{"--textfiles-path", ".", "--token-ttl=500ms"},
+			want:    nil,
+			wantErr: errInvalidTokenTTL,
+		},
+		{
+			name:    "token ttl in fractional seconds should error",
+			args:    []string{"--textfiles-path", ".", "--token-ttl=1.5s"},
+			want:    nil,
+			wantErr: errInvalidTokenTTL,
+		},
+		{
+			name:    "negative retries should error",
+			args:    []string{"--textfiles-path", ".", "--retries=-1"},
+			want:    nil,
+			wantErr: errInvalidRetries,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -426,6 +1417,21 @@ func Test_main(t *testing.T) {
 				"--base-url=" + srv.URL,
 			},
 			want: `(?s)collect-aws-metadata: Fetched http.*\b0 events.*collect-aws-metadata: Wrote /tmp/`},
+		{name: "json to stdout",
+			cliArgs: []string{
+				"collect-aws-metadata",
+				"--format=json",
+				"--output=-",
+				"--base-url=" + srv.URL,
+			},
+			want: `(?s)"instance_id": "i-jklmn".*"events": \[\]`},
+		{name: "show with nothing pending",
+			cliArgs: []string{
+				"collect-aws-metadata",
+				"show",
+				"--base-url=" + srv.URL,
+			},
+			want: `(?s)Instance i-jklmn.*No scheduled maintenance events\.`},
 		{name: "version",
 			cliArgs: []string{
 				"collect-aws-metadata",
@@ -512,7 +1518,7 @@ func Test_fetchToken(t *testing.T) {
 					http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 					return
 				}
-				if ttl := r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"); ttl != TOKEN_TTL {
+				if ttl := r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"); ttl != "21600" {
 					http.Error(w, "Invalid TTL", http.StatusBadRequest)
 					return
 				}
@@ -522,12 +1528,12 @@ func Test_fetchToken(t *testing.T) {
 			wantErr: false,
 		},
 		{
-			name: "IMDSv1 fallback (404)",
+			name: "IMDSv1 only (404)",
 			server: httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "Not found", http.StatusNotFound)
 			})),
 			want:    "",
-			wantErr: false,
+			wantErr: true,
 		},
 		{
 			name: "server error",
@@ -542,7 +1548,7 @@ func Test_fetchToken(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			defer tt.server.Close()
-			got, err := fetchToken(tt.server.URL)
+			got, err := fetchToken(tt.server.URL, DEFAULT_TOKEN_TTL)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("fetchToken() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// call collect right away and then again every opt.interval (plus up to opt.jitter) until ctx is done.
+// collect gets ctx too, so a hook it is running is stopped on shutdown.
+//
+// Errors from collect are logged and the next poll is attempted anyway; a daemon should outlive a
+// briefly unavailable meta-data service.
+func runDaemon(ctx context.Context, opt *collect_options, collect func(context.Context, *collect_options) error) {
+	printInfo(fmt.Sprintf("Collecting every %s (jitter up to %s)", opt.interval, opt.jitter))
+	for {
+		if err := collect(ctx, opt); err != nil {
+			printError(err)
+		}
+
+		timer := time.NewTimer(nextDelay(opt.interval, opt.jitter))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			printInfo("Stopping")
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// how long to wait before the next poll: interval plus a random amount in [0, jitter)
+//
+// jitter spreads a fleet of daemons out so they don't all hit their hosts at the same moment
+func nextDelay(interval, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	return interval + rand.N(jitter)
+}
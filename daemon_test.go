@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_nextDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		jitter   time.Duration
+	}{
+		{name: "no jitter", interval: time.Minute, jitter: 0},
+		{name: "jitter", interval: time.Minute, jitter: 30 * time.Second},
+		{name: "negative jitter is ignored", interval: time.Minute, jitter: -time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				got := nextDelay(tt.interval, tt.jitter)
+				if got < tt.interval || (tt.jitter > 0 && got >= tt.interval+tt.jitter) || (tt.jitter <= 0 && got != tt.interval) {
+					t.Fatalf("nextDelay(%s, %s) = %s, out of range", tt.interval, tt.jitter, got)
+				}
+			}
+		})
+	}
+}
+
+func Test_runDaemon(t *testing.T) {
+	opts := &collect_options{interval: time.Millisecond, jitter: time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	calls := 0
+	collect := func(ctx context.Context, opt *collect_options) error {
+		calls++
+		if calls == 3 {
+			cancel()
+		}
+		// errors are logged and polling continues
+		return errors.New("meta-data service unavailable")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		runDaemon(ctx, opts, collect)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runDaemon() did not stop after its context was canceled")
+	}
+	if calls != 3 {
+		t.Errorf("runDaemon() called collect %d times, want 3", calls)
+	}
+}
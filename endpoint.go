@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const DEFAULT_BASE_URL_IPV6 = "http://[fd00:ec2::254]"
+const ENDPOINT_MODE_IPV4 = "ipv4"
+const ENDPOINT_MODE_IPV6 = "ipv6"
+const ENDPOINT_MODE_AUTO = "auto"
+
+// the environment variables the AWS SDKs use to configure the IMDS client
+const ENV_ENDPOINT = "AWS_EC2_METADATA_SERVICE_ENDPOINT"
+const ENV_ENDPOINT_MODE = "AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE"
+const ENV_DISABLED = "AWS_EC2_METADATA_DISABLED"
+
+var errInvalidEndpointMode = errors.New("--endpoint-mode must be one of: ipv4, ipv6, auto")
+var errIMDSDisabled = errors.New(ENV_DISABLED + " is set; not contacting the meta-data service")
+var errNoEndpoint = errors.New("neither the IPv4 nor the IPv6 meta-data endpoint is reachable")
+
+// settle opt.baseURL and opt.endpointMode like the AWS SDKs do.
+//
+// Precedence, highest first: --base-url, AWS_EC2_METADATA_SERVICE_ENDPOINT, then the default URL for
+// the endpoint mode (--endpoint-mode, else AWS_EC2_METADATA_SERVICE_ENDPOINT_MODE, else ipv4).
+// In auto mode baseURL is left empty, for probeEndpoint to fill in at run time.
+func resolveEndpoint(opt *collect_options, baseURLSet, endpointModeSet bool) error {
+	if strings.EqualFold(os.Getenv(ENV_DISABLED), "true") {
+		return errIMDSDisabled
+	}
+
+	if !endpointModeSet {
+		opt.endpointMode = ENDPOINT_MODE_IPV4
+		if envMode := os.Getenv(ENV_ENDPOINT_MODE); envMode != "" {
+			opt.endpointMode = strings.ToLower(envMode)
+		}
+	}
+
+	var modeURL string
+	switch opt.endpointMode {
+	case ENDPOINT_MODE_IPV4:
+		modeURL = DEFAULT_BASE_URL
+	case ENDPOINT_MODE_IPV6:
+		modeURL = DEFAULT_BASE_URL_IPV6
+	case ENDPOINT_MODE_AUTO:
+		modeURL = ""
+	default:
+		return errInvalidEndpointMode
+	}
+
+	switch {
+	case baseURLSet:
+	case os.Getenv(ENV_ENDPOINT) != "":
+		opt.baseURL = os.Getenv(ENV_ENDPOINT)
+	default:
+		opt.baseURL = modeURL
+	}
+	opt.baseURL = strings.TrimSuffix(opt.baseURL, "/")
+	return nil
+}
+
+// in auto mode, use whichever of the IPv4 and IPv6 endpoints answers first (trying IPv4 first).
+//
+// Any HTTP response counts, even 401 from an instance that requires a token; only a connection
+// failure or timeout rules an endpoint out.
+func probeEndpoint(opt *collect_options) error {
+	for _, candidate := range []string{DEFAULT_BASE_URL, DEFAULT_BASE_URL_IPV6} {
+		resp, err := imdsHTTPClient.Get(candidate + "/latest/meta-data/")
+		if err != nil {
+			printInfo(fmt.Sprintf("Meta-data endpoint %s is not reachable: %s", candidate, err))
+			continue
+		}
+		resp.Body.Close()
+		printInfo(fmt.Sprintf("Using meta-data endpoint %s", candidate))
+		opt.baseURL = candidate
+		return nil
+	}
+	return errNoEndpoint
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_resolveEndpoint(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		baseURL         string // as parsed from --base-url, if baseURLSet
+		baseURLSet      bool
+		endpointMode    string // as parsed from --endpoint-mode, if endpointModeSet
+		endpointModeSet bool
+		wantBaseURL     string
+		wantMode        string
+		wantErr         error
+	}{
+		{name: "defaults",
+			wantBaseURL: DEFAULT_BASE_URL, wantMode: ENDPOINT_MODE_IPV4},
+		{name: "ipv6 flag",
+			endpointMode: ENDPOINT_MODE_IPV6, endpointModeSet: true,
+			wantBaseURL: DEFAULT_BASE_URL_IPV6, wantMode: ENDPOINT_MODE_IPV6},
+		{name: "ipv6 from the environment, like the SDKs spell it",
+			env:         map[string]string{ENV_ENDPOINT_MODE: "IPv6"},
+			wantBaseURL: DEFAULT_BASE_URL_IPV6, wantMode: ENDPOINT_MODE_IPV6},
+		{name: "flag beats environment mode",
+			env:          map[string]string{ENV_ENDPOINT_MODE: "IPv6"},
+			endpointMode: ENDPOINT_MODE_IPV4, endpointModeSet: true,
+			wantBaseURL: DEFAULT_BASE_URL, wantMode: ENDPOINT_MODE_IPV4},
+		{name: "endpoint from the environment",
+			env:         map[string]string{ENV_ENDPOINT: "http://imds.example.com/"},
+			wantBaseURL: "http://imds.example.com", wantMode: ENDPOINT_MODE_IPV4},
+		{name: "--base-url beats the environment",
+			env:     map[string]string{ENV_ENDPOINT: "http://imds.example.com"},
+			baseURL: "http://localhost:8000", baseURLSet: true,
+			wantBaseURL: "http://localhost:8000", wantMode: ENDPOINT_MODE_IPV4},
+		{name: "auto leaves the url for probing",
+			endpointMode: ENDPOINT_MODE_AUTO, endpointModeSet: true,
+			wantBaseURL: "", wantMode: ENDPOINT_MODE_AUTO},
+		{name: "bad mode from the environment",
+			env:     map[string]string{ENV_ENDPOINT_MODE: "IPv5"},
+			wantErr: errInvalidEndpointMode},
+		{name: "disabled",
+			env:     map[string]string{ENV_DISABLED: "True"},
+			wantErr: errIMDSDisabled},
+		{name: "not disabled",
+			env:         map[string]string{ENV_DISABLED: "false"},
+			wantBaseURL: DEFAULT_BASE_URL, wantMode: ENDPOINT_MODE_IPV4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{ENV_ENDPOINT, ENV_ENDPOINT_MODE, ENV_DISABLED} {
+				t.Setenv(name, tt.env[name])
+			}
+			opts := &collect_options{baseURL: tt.baseURL, endpointMode: tt.endpointMode}
+			err := resolveEndpoint(opts, tt.baseURLSet, tt.endpointModeSet)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolveEndpoint() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if opts.baseURL != tt.wantBaseURL || opts.endpointMode != tt.wantMode {
+				t.Errorf("resolveEndpoint() = %q, %q; want %q, %q", opts.baseURL, opts.endpointMode, tt.wantBaseURL, tt.wantMode)
+			}
+		})
+	}
+}
+
+func Test_probeEndpoint(t *testing.T) {
+	// stand in for both link-local endpoints with a client that dials a test server for one of them
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized) // still proves the endpoint is there
+	}))
+	defer srv.Close()
+
+	origClient := imdsHTTPClient
+	defer func() { imdsHTTPClient = origClient }()
+
+	tests := []struct {
+		name      string
+		reachable string // which endpoint the fake transport lets through
+		want      string
+		wantErr   error
+	}{
+		{name: "ipv4", reachable: "169.254.169.254", want: DEFAULT_BASE_URL},
+		{name: "ipv6", reachable: "[fd00:ec2::254]", want: DEFAULT_BASE_URL_IPV6},
+		{name: "neither", reachable: "", wantErr: errNoEndpoint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imdsHTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				if r.URL.Host != tt.reachable {
+					return nil, errors.New("no route to host")
+				}
+				r.URL.Host = srv.Listener.Addr().String()
+				return http.DefaultTransport.RoundTrip(r)
+			})}
+			opts := &collect_options{endpointMode: ENDPOINT_MODE_AUTO}
+			err := probeEndpoint(opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("probeEndpoint() error = %v, want %v", err, tt.wantErr)
+			}
+			if opts.baseURL != tt.want {
+				t.Errorf("probeEndpoint() chose %q, want %q", opts.baseURL, tt.want)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// kinds of event change, as the `change` label on aws_maintenance_event_changes_total
+const CHANGE_NEW = "new"
+const CHANGE_RESCHEDULED = "rescheduled" // NotBefore or NotAfter moved
+const CHANGE_STATE_CHANGED = "state_changed"
+const CHANGE_VANISHED = "vanished" // AWS no longer lists it
+
+const EVENT_STATE_MODE = 0644
+
+var EVENT_CHANGE_KINDS = []string{CHANGE_NEW, CHANGE_RESCHEDULED, CHANGE_STATE_CHANGED, CHANGE_VANISHED}
+
+// what --state-path holds between runs
+type event_state_file struct {
+	InstanceID string                   `json:"instance_id"` // the state is thrown away if this changes
+	Events     map[string]tracked_event `json:"events"`      // by EventId
+	Changes    map[string]int64         `json:"changes"`     // counts since the file was created, by kind
+}
+
+// an event as last seen
+type tracked_event struct {
+	Code        string    `json:"code"`
+	State       string    `json:"state"`
+	Description string    `json:"description"`
+	NotBefore   string    `json:"not_before"`
+	NotAfter    string    `json:"not_after"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// one difference between the last run and this one
+type event_change struct {
+	kind    string // CHANGE_NEW, etc.
+	eventID string
+	before  *tracked_event // nil for CHANGE_NEW
+	after   *tracked_event // nil for CHANGE_VANISHED
+}
+
+// a one-line description for the log
+func (c event_change) String() string {
+	switch c.kind {
+	case CHANGE_NEW:
+		return fmt.Sprintf("Event %s is new: %s, %s, %s - %s", c.eventID, c.after.Code, c.after.State, c.after.NotBefore, c.after.NotAfter)
+	case CHANGE_RESCHEDULED:
+		return fmt.Sprintf("Event %s was rescheduled: %s - %s -> %s - %s", c.eventID,
+			c.before.NotBefore, c.before.NotAfter, c.after.NotBefore, c.after.NotAfter)
+	case CHANGE_STATE_CHANGED:
+		return fmt.Sprintf("Event %s changed state: %s -> %s", c.eventID, c.before.State, c.after.State)
+	default:
+		return fmt.Sprintf("Event %s vanished: was %s, %s", c.eventID, c.before.Code, c.before.State)
+	}
+}
+
+// compare the events with --state-path, log and count what changed, and save them for next time.
+//
+// Sets metadata.eventChanges for the metrics and returns the changes. Does nothing without --state-path.
+func trackEvents(opt *collect_options, metadata *fetched_metadata) ([]event_change, error) {
+	if opt.statePath == "" {
+		return nil, nil
+	}
+	state := &event_state_file{}
+	err := loadStateFile(opt.statePath, state)
+	if errors.Is(err, errCorruptStateFile) {
+		// starting over only resets the counters, which Prometheus copes with
+		printInfo(fmt.Sprintf("Starting a new state file: %s", err))
+		state, err = &event_state_file{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if state.InstanceID != metadata.instanceID {
+		// a new file, or the volume was moved to another instance: start over
+		state = &event_state_file{InstanceID: metadata.instanceID}
+	}
+	if state.Changes == nil {
+		state.Changes = map[string]int64{}
+	}
+
+	now := time.Now()
+	changes := diffEvents(state.Events, metadata.events, now)
+	for _, change := range changes {
+		printInfo(change.String())
+		state.Changes[change.kind]++
+	}
+
+	// every listed event, changed or not; vanished ones are dropped
+	previous := state.Events
+	state.Events = map[string]tracked_event{}
+	for _, ev := range metadata.events {
+		state.Events[ev.EventId] = trackedEvent(ev, previous[ev.EventId].FirstSeen, now)
+	}
+
+	if err := saveStateFile(opt.statePath, EVENT_STATE_MODE, state); err != nil {
+		return nil, err
+	}
+
+	metadata.eventChanges = map[string]int64{}
+	for _, kind := range EVENT_CHANGE_KINDS {
+		metadata.eventChanges[kind] = state.Changes[kind]
+	}
+	return changes, nil
+}
+
+// what changed from `previous` to `events`, in the order of `events`, then vanished ones by id
+func diffEvents(previous map[string]tracked_event, events []maintenance_event, now time.Time) []event_change {
+	var changes []event_change
+	listed := map[string]bool{}
+	for _, ev := range events {
+		listed[ev.EventId] = true
+		after := trackedEvent(ev, now, now)
+		before, ok := previous[ev.EventId]
+		if !ok {
+			changes = append(changes, event_change{kind: CHANGE_NEW, eventID: ev.EventId, after: &after})
+			continue
+		}
+		after.FirstSeen = before.FirstSeen
+		if before.NotBefore != after.NotBefore || before.NotAfter != after.NotAfter {
+			changes = append(changes, event_change{kind: CHANGE_RESCHEDULED, eventID: ev.EventId, before: &before, after: &after})
+		}
+		if before.State != after.State {
+			changes = append(changes, event_change{kind: CHANGE_STATE_CHANGED, eventID: ev.EventId, before: &before, after: &after})
+		}
+	}
+
+	var vanished []string
+	for id := range previous {
+		if !listed[id] {
+			vanished = append(vanished, id)
+		}
+	}
+	slices.Sort(vanished)
+	for _, id := range vanished {
+		before := previous[id]
+		changes = append(changes, event_change{kind: CHANGE_VANISHED, eventID: id, before: &before})
+	}
+	return changes
+}
+
+// an event as it is now; firstSeen is now if it is zero
+func trackedEvent(ev maintenance_event, firstSeen, now time.Time) tracked_event {
+	if firstSeen.IsZero() {
+		firstSeen = now
+	}
+	return tracked_event{
+		Code:        ev.Code,
+		State:       ev.State,
+		Description: ev.Description,
+		NotBefore:   ev.NotBefore,
+		NotAfter:    ev.NotAfter,
+		FirstSeen:   firstSeen,
+		LastSeen:    now,
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_diffEvents(t *testing.T) {
+	now := time.Date(2020, 1, 20, 10, 0, 0, 0, time.UTC)
+	firstSeen := now.Add(-time.Hour)
+	previous := map[string]tracked_event{
+		"ev-same":  {Code: "system-reboot", State: "active", NotBefore: "21 Jan 2020 09:00:00 GMT", FirstSeen: firstSeen},
+		"ev-moved": {Code: "system-reboot", State: "active", NotBefore: "21 Jan 2020 09:00:00 GMT", NotAfter: "21 Jan 2020 11:00:00 GMT"},
+		"ev-both":  {Code: "system-reboot", State: "active", NotBefore: "21 Jan 2020 09:00:00 GMT"},
+		"ev-gone":  {Code: "instance-stop", State: "active", NotBefore: "19 Jan 2020 09:00:00 GMT"},
+	}
+	events := []maintenance_event{
+		{EventId: "ev-same", Code: "system-reboot", State: "active", NotBefore: "21 Jan 2020 09:00:00 GMT"},
+		{EventId: "ev-moved", Code: "system-reboot", State: "active", NotBefore: "22 Jan 2020 09:00:00 GMT", NotAfter: "22 Jan 2020 11:00:00 GMT"},
+		{EventId: "ev-both", Code: "system-reboot", State: "canceled", NotBefore: "23 Jan 2020 09:00:00 GMT"},
+		{EventId: "ev-new", Code: "instance-reboot", State: "active", NotBefore: "24 Jan 2020 09:00:00 GMT"},
+	}
+
+	var got []string
+	for _, change := range diffEvents(previous, events, now) {
+		got = append(got, change.kind+" "+change.eventID)
+	}
+	want := []string{
+		"rescheduled ev-moved",
+		"rescheduled ev-both",
+		"state_changed ev-both",
+		"new ev-new",
+		"vanished ev-gone",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffEvents() = %q, want %q", got, want)
+	}
+}
+
+func Test_event_change_String(t *testing.T) {
+	before := &tracked_event{Code: "system-reboot", State: "active", NotBefore: "21 Jan 2020 09:00:00 GMT"}
+	after := &tracked_event{Code: "system-reboot", State: "completed", NotBefore: "22 Jan 2020 09:00:00 GMT"}
+	tests := []struct {
+		change event_change
+		want   string
+	}{
+		{event_change{kind: CHANGE_NEW, eventID: "ev-1", after: after},
+			"Event ev-1 is new: system-reboot, completed, 22 Jan 2020 09:00:00 GMT - "},
+		{event_change{kind: CHANGE_RESCHEDULED, eventID: "ev-1", before: before, after: after},
+			"Event ev-1 was rescheduled: 21 Jan 2020 09:00:00 GMT -  -> 22 Jan 2020 09:00:00 GMT - "},
+		{event_change{kind: CHANGE_STATE_CHANGED, eventID: "ev-1", before: before, after: after},
+			"Event ev-1 changed state: active -> completed"},
+		{event_change{kind: CHANGE_VANISHED, eventID: "ev-1", before: before},
+			"Event ev-1 vanished: was system-reboot, active"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.change.kind, func(t *testing.T) {
+			if got := tt.change.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_trackEvents(t *testing.T) {
+	opt := &collect_options{statePath: filepath.Join(t.TempDir(), "events.json")}
+	metadata := func(events ...maintenance_event) *fetched_metadata {
+		return &fetched_metadata{instanceID: "i-jklmn", events: events}
+	}
+	ev := maintenance_event{EventId: "ev-1", State: "active", NotBefore: "21 Jan 2020 09:00:00 GMT"}
+
+	// without --state-path, nothing happens
+	md := metadata(ev)
+	if changes, err := trackEvents(&collect_options{}, md); err != nil || changes != nil || md.eventChanges != nil {
+		t.Fatalf("trackEvents() without --state-path = %v, %v, %v", changes, err, md.eventChanges)
+	}
+
+	steps := []struct {
+		name     string
+		metadata *fetched_metadata
+		want     map[string]int64
+	}{
+		{"first seen", metadata(ev), map[string]int64{CHANGE_NEW: 1, CHANGE_RESCHEDULED: 0, CHANGE_STATE_CHANGED: 0, CHANGE_VANISHED: 0}},
+		{"unchanged", metadata(ev), map[string]int64{CHANGE_NEW: 1, CHANGE_RESCHEDULED: 0, CHANGE_STATE_CHANGED: 0, CHANGE_VANISHED: 0}},
+		{"completed", metadata(maintenance_event{EventId: "ev-1", State: "completed", NotBefore: ev.NotBefore}),
+			map[string]int64{CHANGE_NEW: 1, CHANGE_RESCHEDULED: 0, CHANGE_STATE_CHANGED: 1, CHANGE_VANISHED: 0}},
+		{"gone", metadata(), map[string]int64{CHANGE_NEW: 1, CHANGE_RESCHEDULED: 0, CHANGE_STATE_CHANGED: 1, CHANGE_VANISHED: 1}},
+	}
+	for _, step := range steps {
+		if _, err := trackEvents(opt, step.metadata); err != nil {
+			t.Fatalf("%s: trackEvents() error = %v", step.name, err)
+		}
+		if !reflect.DeepEqual(step.metadata.eventChanges, step.want) {
+			t.Errorf("%s: eventChanges = %v, want %v", step.name, step.metadata.eventChanges, step.want)
+		}
+	}
+
+	// another instance starts over
+	md = &fetched_metadata{instanceID: "i-other"}
+	if _, err := trackEvents(opt, md); err != nil || md.eventChanges[CHANGE_NEW] != 0 {
+		t.Errorf("trackEvents() on another instance = %v, %v", md.eventChanges, err)
+	}
+
+	// so does an unreadable file
+	os.WriteFile(opt.statePath, []byte("{not json"), 0644)
+	md = metadata(ev)
+	if _, err := trackEvents(opt, md); err != nil || md.eventChanges[CHANGE_NEW] != 1 {
+		t.Errorf("trackEvents() after a bad file = %v, %v", md.eventChanges, err)
+	}
+}
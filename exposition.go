@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// metric types, as written on # TYPE lines. The Prometheus text format has no info or stateset; those
+// are written there as gauges.
+const METRIC_TYPE_GAUGE = "gauge"
+const METRIC_TYPE_COUNTER = "counter"
+const METRIC_TYPE_INFO = "info"
+const METRIC_TYPE_STATESET = "stateset"
+
+const FORMAT_PROMETHEUS = "prometheus"
+const FORMAT_OPENMETRICS = "openmetrics"
+
+var errInvalidFormat = errors.New("--format must be one of: prometheus, openmetrics, json")
+var errInvalidMetricPrefix = errors.New("--metric-prefix must start with a letter, _ or :, followed by letters, digits, _ or :")
+var errColonInOpenMetricsPrefix = errors.New("--metric-prefix can't contain : with --format=openmetrics, since state sets use the metric name as a label name")
+
+var validMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var openMetricsHelpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// a label name and its (unescaped) value
+type label struct {
+	name, value string
+}
+
+type metric_sample struct {
+	labels []label
+	value  float64
+}
+
+// every sample of one metric, written together under a single # HELP and # TYPE
+//
+// name is the sample name; for an info or counter, that includes the _info or _total suffix. For a state set, stateLabel is
+// the label that holds the state in the Prometheus format (OpenMetrics names it after the family).
+type metric_family struct {
+	name, help, metricType, unit, stateLabel string
+	samples                                  []metric_sample
+}
+
+// metric families, written in the order they were added so the file diffs cleanly from run to run
+type metric_set struct {
+	prefix   string
+	families []*metric_family
+}
+
+func newMetricSet(prefix string) *metric_set {
+	return &metric_set{prefix: prefix}
+}
+
+// check a --metric-prefix; empty is fine, otherwise it has to be usable at the start of a metric name.
+// With OpenMetrics it can't have a colon, since a state set's label is named after its (prefixed)
+// metric and label names can't have colons.
+func validateMetricPrefix(prefix, format string) error {
+	if prefix != "" && !validMetricName.MatchString(prefix) {
+		return errInvalidMetricPrefix
+	}
+	if format == FORMAT_OPENMETRICS && strings.Contains(prefix, ":") {
+		return errColonInOpenMetricsPrefix
+	}
+	return nil
+}
+
+// add a metric family to the set. A family with no samples is left out of the output.
+func (s *metric_set) family(name, metricType, help string) *metric_family {
+	f := &metric_family{name: s.prefix + name, help: help, metricType: metricType}
+	s.families = append(s.families, f)
+	return f
+}
+
+// add a state set to the set; add its samples with addState
+func (s *metric_set) stateSet(name, stateLabel, help string) *metric_family {
+	f := s.family(name, METRIC_TYPE_STATESET, help)
+	f.stateLabel = stateLabel
+	return f
+}
+
+// set the unit, for the # UNIT line in OpenMetrics. The name has to end in _<unit>.
+func (f *metric_family) withUnit(unit string) *metric_family {
+	f.unit = unit
+	return f
+}
+
+// add a sample; labels are written in the order given
+func (f *metric_family) add(value float64, labels ...label) {
+	f.samples = append(f.samples, metric_sample{labels: labels, value: value})
+}
+
+// add one state of a state set: 1 if it is the current state, else 0
+func (f *metric_family) addState(state string, current bool, labels ...label) {
+	labels = append(slices.Clip(labels), label{f.stateLabel, state})
+	f.add(boolToFloat(current), labels...)
+}
+
+// write the set as `format` (FORMAT_PROMETHEUS or FORMAT_OPENMETRICS). Samples in a family are sorted
+// by their labels.
+func (s *metric_set) write(writer io.Writer, format string) error {
+	openMetrics := format == FORMAT_OPENMETRICS
+	var buf bytes.Buffer
+	for _, f := range s.families {
+		if len(f.samples) == 0 {
+			continue
+		}
+		familyName, metricType, help := f.name, f.metricType, helpEscaper.Replace(f.help)
+		if openMetrics {
+			switch metricType {
+			case METRIC_TYPE_INFO:
+				familyName = strings.TrimSuffix(f.name, "_info")
+			case METRIC_TYPE_COUNTER:
+				familyName = strings.TrimSuffix(f.name, "_total")
+			}
+			help = openMetricsHelpEscaper.Replace(f.help)
+		} else if metricType == METRIC_TYPE_INFO || metricType == METRIC_TYPE_STATESET {
+			metricType = METRIC_TYPE_GAUGE
+		}
+		buf.WriteString("# HELP " + familyName + " " + help + "\n")
+		buf.WriteString("# TYPE " + familyName + " " + metricType + "\n")
+		if openMetrics && f.unit != "" {
+			buf.WriteString("# UNIT " + familyName + " " + f.unit + "\n")
+		}
+
+		lines := make([]string, 0, len(f.samples))
+		for _, sample := range f.samples {
+			labels := sample.labels
+			if openMetrics && f.stateLabel != "" {
+				labels = renameLabel(labels, f.stateLabel, f.name)
+			}
+			lines = append(lines, f.name+formatLabels(labels)+" "+formatValue(sample.value)+"\n")
+		}
+		slices.Sort(lines)
+		for _, line := range lines {
+			buf.WriteString(line)
+		}
+	}
+	if openMetrics {
+		buf.WriteString("# EOF\n")
+	}
+	_, err := writer.Write(buf.Bytes())
+	return err
+}
+
+// a copy of labels with `from` renamed to `to`
+func renameLabel(labels []label, from, to string) []label {
+	ret := slices.Clone(labels)
+	for i := range ret {
+		if ret[i].name == from {
+			ret[i].name = to
+		}
+	}
+	return ret
+}
+
+// `{a="x",b="y"}`, or "" for no labels
+func formatLabels(labels []label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.name+`="`+escapeLabelValue(l.value)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// the shortest representation that round-trips; whole numbers (timestamps, counts) have no exponent
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func Test_metric_set_write(t *testing.T) {
+	set := newMetricSet("p_")
+	b := set.family("b", METRIC_TYPE_GAUGE, "second family\nwith a \\ in help")
+	set.family("empty", METRIC_TYPE_GAUGE, "never written")
+	a := set.family("a", METRIC_TYPE_GAUGE, "third family")
+	b.add(2, label{"k", "z"})
+	b.add(1, label{"k", "y"})
+	a.add(0.5)
+
+	var buf bytes.Buffer
+	if err := set.write(&buf, FORMAT_PROMETHEUS); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	want := "# HELP p_b second family\\nwith a \\\\ in help\n" +
+		"# TYPE p_b gauge\n" +
+		"p_b{k=\"y\"} 1\n" +
+		"p_b{k=\"z\"} 2\n" +
+		"# HELP p_a third family\n" +
+		"# TYPE p_a gauge\n" +
+		"p_a 0.5\n"
+	if buf.String() != want {
+		t.Errorf("write() = %q, want %q", buf.String(), want)
+	}
+}
+
+func Test_metric_set_write_openmetrics(t *testing.T) {
+	set := newMetricSet("")
+	set.family("thing_info", METRIC_TYPE_INFO, `a "thing"`).add(1, label{"name", "x"})
+	set.family("wait_seconds", METRIC_TYPE_GAUGE, "how long").withUnit("seconds").add(3)
+	set.family("runs_total", METRIC_TYPE_COUNTER, "runs").add(7)
+	mode := set.stateSet("mode", "mode_label", "which mode")
+	mode.addState("on", true)
+	mode.addState("off", false)
+
+	var buf bytes.Buffer
+	if err := set.write(&buf, FORMAT_OPENMETRICS); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	want := "# HELP thing a \\\"thing\\\"\n" +
+		"# TYPE thing info\n" +
+		"thing_info{name=\"x\"} 1\n" +
+		"# HELP wait_seconds how long\n" +
+		"# TYPE wait_seconds gauge\n" +
+		"# UNIT wait_seconds seconds\n" +
+		"wait_seconds 3\n" +
+		"# HELP runs runs\n" +
+		"# TYPE runs counter\n" +
+		"runs_total 7\n" +
+		"# HELP mode which mode\n" +
+		"# TYPE mode stateset\n" +
+		"mode{mode=\"off\"} 0\n" +
+		"mode{mode=\"on\"} 1\n" +
+		"# EOF\n"
+	if buf.String() != want {
+		t.Errorf("write() = %q, want %q", buf.String(), want)
+	}
+
+	// the same set in the Prometheus format: gauges, with the state in its own label
+	buf.Reset()
+	if err := set.write(&buf, FORMAT_PROMETHEUS); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	for _, line := range []string{"# TYPE thing_info gauge\n", "# TYPE runs_total counter\n", "# TYPE mode gauge\n", "mode{mode_label=\"on\"} 1\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("write() = %q, want it to contain %q", buf.String(), line)
+		}
+	}
+	if strings.Contains(buf.String(), "# EOF") || strings.Contains(buf.String(), "# UNIT") {
+		t.Errorf("write() = %q, has OpenMetrics-only lines", buf.String())
+	}
+}
+
+func Test_formatValue(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{1579510843, "1579510843"},
+		{-86400, "-86400"},
+		{0.25, "0.25"},
+		{math.NaN(), "NaN"},
+		{math.Inf(1), "+Inf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatValue(tt.v); got != tt.want {
+				t.Errorf("formatValue(%v) = %s, want %s", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateMetricPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		format  string
+		wantErr error
+	}{
+		{"", FORMAT_PROMETHEUS, nil},
+		{"amcs_", FORMAT_PROMETHEUS, nil},
+		{"ns:sub_", FORMAT_PROMETHEUS, nil},
+		{"org:", FORMAT_JSON, nil},
+		{"_private", FORMAT_PROMETHEUS, nil},
+		{"amcs_", FORMAT_OPENMETRICS, nil},
+		{"org:", FORMAT_OPENMETRICS, errColonInOpenMetricsPrefix},
+		{"9lives_", FORMAT_PROMETHEUS, errInvalidMetricPrefix},
+		{"my-app_", FORMAT_PROMETHEUS, errInvalidMetricPrefix},
+		{"sp ace_", FORMAT_PROMETHEUS, errInvalidMetricPrefix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix+" "+tt.format, func(t *testing.T) {
+			if err := validateMetricPrefix(tt.prefix, tt.format); !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateMetricPrefix(%q, %q) error = %v, want %v", tt.prefix, tt.format, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HOOK_TRIGGER_NEW = "new"             // the event was seen for the first time
+const HOOK_TRIGGER_LEAD_TIME = "lead-time" // the event starts within one of --hook-lead-times
+const DEFAULT_HOOK_TIMEOUT = 5 * time.Minute
+const HOOK_KILL_GRACE = 5 * time.Second // after the timeout kills the hook, how long to wait for its output
+const HOOK_LEDGER_MODE = 0600
+
+var errHookStatePathRequired = errors.New("--hook-command needs --hook-state-path, to run each hook only once")
+var errInvalidHookLeadTimes = errors.New("--hook-lead-times must be a comma-separated list of durations greater than 0, like 24h,1h")
+var errInvalidHookTimeout = errors.New("--hook-timeout must be greater than 0")
+
+// the hooks that have run, by event id, then "new" or the lead time, with when they ran.
+//
+// Kept in --hook-state-path so each hook runs at most once per event, across runs.
+type hook_ledger map[string]map[string]time.Time
+
+// what a hook gets as JSON on stdin
+type hook_payload struct {
+	Trigger    string     `json:"trigger"`             // HOOK_TRIGGER_NEW or HOOK_TRIGGER_LEAD_TIME
+	LeadTime   string     `json:"lead_time,omitempty"` // with HOOK_TRIGGER_LEAD_TIME, e.g. "1h0m0s"
+	InstanceID string     `json:"instance_id"`
+	Event      json_event `json:"event"`
+}
+
+// parse --hook-lead-times ("24h,1h"), longest first
+func parseLeadTimes(s string) ([]time.Duration, error) {
+	var ret []time.Duration
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		d, err := time.ParseDuration(field)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w: %s", errInvalidHookLeadTimes, field)
+		}
+		ret = append(ret, d)
+	}
+	slices.Sort(ret)
+	slices.Reverse(ret)
+	return slices.Compact(ret), nil
+}
+
+// run --hook-command for events that are new, or have come within a lead time, and haven't had that
+// hook yet. Only the shortest lead time an event is within runs; longer ones it skipped past (e.g. it
+// was first seen an hour before it starts) are marked as done without running.
+//
+// A hook that fails or times out is logged and not retried, and so is one killed because ctx was canceled
+// (the daemon is stopping). An error is only returned when the ledger can't be read or written, since
+// then a hook might run twice.
+func runHooks(ctx context.Context, opt *collect_options, metadata *fetched_metadata) error {
+	if opt.hookCommand == "" {
+		return nil
+	}
+	ledger := hook_ledger{}
+	if err := loadStateFile(opt.hookStatePath, &ledger); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, ev := range metadata.events {
+		seen[ev.EventId] = true
+		if !eventPending(ev) {
+			continue
+		}
+		event, err := newJSONEvent(ev, now)
+		if err != nil {
+			return err
+		}
+		if ledger[ev.EventId] == nil {
+			ledger[ev.EventId] = map[string]time.Time{}
+		}
+		fired := ledger[ev.EventId]
+
+		var due []hook_payload
+		if _, ok := fired[HOOK_TRIGGER_NEW]; !ok {
+			fired[HOOK_TRIGGER_NEW] = now
+			due = append(due, hook_payload{Trigger: HOOK_TRIGGER_NEW, InstanceID: metadata.instanceID, Event: event})
+		}
+		var tightest *hook_payload
+		for _, lead := range opt.hookLeadTimes { // longest first
+			if event.NotBefore.Sub(now) > lead {
+				break
+			}
+			if _, ok := fired[lead.String()]; ok {
+				tightest = nil
+				continue
+			}
+			fired[lead.String()] = now
+			tightest = &hook_payload{Trigger: HOOK_TRIGGER_LEAD_TIME, LeadTime: lead.String(), InstanceID: metadata.instanceID, Event: event}
+		}
+		if tightest != nil {
+			due = append(due, *tightest)
+		}
+
+		// record before running, so a crash or restart mid-hook can't run it again
+		if len(due) > 0 {
+			if err := saveStateFile(opt.hookStatePath, HOOK_LEDGER_MODE, ledger); err != nil {
+				return err
+			}
+		}
+		for _, payload := range due {
+			if err := runHook(ctx, opt, payload); err != nil {
+				printError(err)
+			}
+		}
+	}
+
+	// forget events AWS no longer lists, so the ledger doesn't grow forever
+	pruned := false
+	for id := range ledger {
+		if !seen[id] {
+			delete(ledger, id)
+			pruned = true
+		}
+	}
+	if pruned {
+		return saveStateFile(opt.hookStatePath, HOOK_LEDGER_MODE, ledger)
+	}
+	return nil
+}
+
+// run --hook-command once with the event in its environment and as JSON on stdin, logging its output.
+// It is killed after --hook-timeout, or when ctx is canceled.
+func runHook(ctx context.Context, opt *collect_options, payload hook_payload) error {
+	what := fmt.Sprintf("%s hook for %s", payload.Trigger, payload.Event.EventID)
+	if payload.LeadTime != "" {
+		what = fmt.Sprintf("%s %s hook for %s", payload.LeadTime, payload.Trigger, payload.Event.EventID)
+	}
+	stdin, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	hookCtx, cancel := context.WithTimeout(ctx, opt.hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(hookCtx, "/bin/sh", "-c", opt.hookCommand)
+	cmd.Env = append(os.Environ(), hookEnv(payload)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.WaitDelay = HOOK_KILL_GRACE
+
+	printInfo("Running " + what)
+	output, err := cmd.CombinedOutput()
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		printInfo(what + ": " + scanner.Text())
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("%s stopped: %w", what, ctx.Err())
+	}
+	if hookCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %s", what, opt.hookTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", what, err)
+	}
+	printInfo(what + " finished")
+	return nil
+}
+
+// the event as environment variables for a hook
+func hookEnv(payload hook_payload) []string {
+	notAfter := ""
+	if payload.Event.NotAfter != nil {
+		notAfter = payload.Event.NotAfter.Format(time.RFC3339)
+	}
+	return []string{
+		"HOOK_TRIGGER=" + payload.Trigger,
+		"HOOK_LEAD_TIME=" + payload.LeadTime,
+		"AWS_INSTANCE_ID=" + payload.InstanceID,
+		"AWS_EVENT_ID=" + payload.Event.EventID,
+		"AWS_EVENT_CODE=" + payload.Event.Code,
+		"AWS_EVENT_STATE=" + payload.Event.State,
+		"AWS_EVENT_DESCRIPTION=" + payload.Event.Description,
+		"AWS_EVENT_NOT_BEFORE=" + payload.Event.NotBefore.Format(time.RFC3339),
+		"AWS_EVENT_NOT_AFTER=" + notAfter,
+		"AWS_EVENT_SECONDS_UNTIL_START=" + strconv.FormatInt(payload.Event.SecondsUntilStart, 10),
+	}
+}
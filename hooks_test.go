@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseLeadTimes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []time.Duration
+		wantErr error
+	}{
+		{"", nil, nil},
+		{"1h,24h, 1h", []time.Duration{24 * time.Hour, time.Hour}, nil},
+		{"30m", []time.Duration{30 * time.Minute}, nil},
+		{"1d", nil, errInvalidHookLeadTimes},
+		{"1h,-5m", nil, errInvalidHookLeadTimes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseLeadTimes(tt.in)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseLeadTimes() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseLeadTimes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// a hook that appends its trigger and event to calls.txt, and its stdin to stdin.json
+func helpHookOptions(t *testing.T) (*collect_options, string) {
+	dir := t.TempDir()
+	return &collect_options{
+		hookCommand: `echo "$HOOK_TRIGGER $HOOK_LEAD_TIME $AWS_EVENT_ID $AWS_EVENT_CODE" >> ` + filepath.Join(dir, "calls.txt") +
+			` && cat > ` + filepath.Join(dir, "stdin.json"),
+		hookStatePath: filepath.Join(dir, "hooks.json"),
+		hookLeadTimes: []time.Duration{24 * time.Hour, time.Hour},
+		hookTimeout:   10 * time.Second,
+	}, dir
+}
+
+func Test_runHooks(t *testing.T) {
+	opt, dir := helpHookOptions(t)
+	startsIn := func(d time.Duration) string { return time.Now().Add(d).UTC().Format(AWS_EVENT_TIME_FORMAT) }
+	metadata := &fetched_metadata{instanceID: "i-jklmn", events: []maintenance_event{
+		{EventId: "ev-soon", Code: "system-reboot", State: "active", NotBefore: startsIn(30 * time.Minute)},
+		{EventId: "ev-later", Code: "instance-stop", State: "active", NotBefore: startsIn(240 * time.Hour)},
+		{EventId: "ev-done", Code: "system-reboot", State: "completed", NotBefore: startsIn(-time.Hour)},
+	}}
+
+	calls := func() []string {
+		data, _ := os.ReadFile(filepath.Join(dir, "calls.txt"))
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+
+	if err := runHooks(context.Background(), opt, metadata); err != nil {
+		t.Fatalf("runHooks() error = %v", err)
+	}
+	// ev-soon skips straight to the 1h hook; ev-done has nothing to do
+	want := []string{
+		"new  ev-soon system-reboot",
+		"lead-time 1h0m0s ev-soon system-reboot",
+		"new  ev-later instance-stop",
+	}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hooks ran %q, want %q", got, want)
+	}
+
+	var payload hook_payload
+	data, _ := os.ReadFile(filepath.Join(dir, "stdin.json"))
+	if err := json.Unmarshal(data, &payload); err != nil || payload.Event.EventID != "ev-later" || payload.InstanceID != "i-jklmn" {
+		t.Errorf("last hook got %s on stdin (%v)", data, err)
+	}
+
+	// nothing runs twice
+	if err := runHooks(context.Background(), opt, metadata); err != nil {
+		t.Fatalf("runHooks() error = %v", err)
+	}
+	if got := calls(); len(got) != len(want) {
+		t.Errorf("hooks ran again: %q", got)
+	}
+
+	// vanished events are forgotten
+	metadata.events = metadata.events[:1]
+	if err := runHooks(context.Background(), opt, metadata); err != nil {
+		t.Fatalf("runHooks() error = %v", err)
+	}
+	ledger := hook_ledger{}
+	if err := loadStateFile(opt.hookStatePath, &ledger); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ledger["ev-later"]; ok || len(ledger["ev-soon"]) != 3 {
+		t.Errorf("ledger = %v, want only ev-soon with new, 24h and 1h", ledger)
+	}
+}
+
+func Test_runHooks_badLedger(t *testing.T) {
+	opt, dir := helpHookOptions(t)
+	os.WriteFile(opt.hookStatePath, []byte("{not json"), 0600)
+	metadata := &fetched_metadata{events: []maintenance_event{
+		{EventId: "ev-1", State: "active", NotBefore: "20 Jan 2030 09:00:00 GMT"},
+	}}
+	if err := runHooks(context.Background(), opt, metadata); err == nil {
+		t.Error("runHooks() with a bad ledger, wanted an error")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "calls.txt")); err == nil {
+		t.Error("a hook ran without a usable ledger")
+	}
+}
+
+func Test_runHook(t *testing.T) {
+	payload := hook_payload{Trigger: HOOK_TRIGGER_NEW, Event: json_event{EventID: "ev-1"}}
+
+	opt := &collect_options{hookCommand: "exec sleep 5", hookTimeout: 100 * time.Millisecond}
+	if err := runHook(context.Background(), opt, payload); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("runHook() error = %v, want a timeout", err)
+	}
+
+	opt = &collect_options{hookCommand: "echo draining; exit 3", hookTimeout: 10 * time.Second}
+	if err := runHook(context.Background(), opt, payload); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Errorf("runHook() error = %v, want exit status 3", err)
+	}
+
+	// the daemon stopping kills the hook well before --hook-timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	opt = &collect_options{hookCommand: "exec sleep 5", hookTimeout: time.Minute}
+	start := time.Now()
+	if err := runHook(ctx, opt, payload); !errors.Is(err, context.Canceled) {
+		t.Errorf("runHook() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("runHook() took %s to stop after ctx was canceled", elapsed)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const RETRY_BASE_DELAY = 250 * time.Millisecond
+const RETRY_MAX_DELAY = 5 * time.Second
+
+// replaceable in a test, so retries don't slow it down
+var retrySleep func(d time.Duration) = time.Sleep
+
+// an HTTP client for IMDS with the connect and overall timeouts from opt.
+//
+// IMDS is link-local, so sending its requests through an egress proxy would fail at best and leak
+// the token at worst; HTTP_PROXY and friends are ignored unless --imds-use-proxy says otherwise.
+func newIMDSHTTPClient(opt *collect_options) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: opt.connectTimeout}).DialContext
+	if opt.imdsUseProxy {
+		transport.Proxy = http.ProxyFromEnvironment
+		printInfo("Meta-data requests will use the proxy from HTTP_PROXY/NO_PROXY, if any (--imds-use-proxy)")
+	} else {
+		transport.Proxy = nil
+		printInfo("Meta-data requests will connect directly, ignoring any HTTP_PROXY")
+	}
+	return &http.Client{Transport: transport, Timeout: opt.requestTimeout}
+}
+
+// whether a failed IMDS request is worth trying again: connection errors and timeouts, 429 and 5xx.
+// Other 4xx responses won't change on a retry (401 is handled separately, by refreshing the token),
+// and neither will errors of our own, like errIMDSv2Unavailable.
+func isRetryable(err error) bool {
+	var statusErr *HTTPErrorStatusCode
+	if errors.As(err, &statusErr) {
+		return statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+	}
+	// *url.Error is a net.Error itself, so look at what it wraps
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// exponential backoff from RETRY_BASE_DELAY, capped at RETRY_MAX_DELAY, with the upper half jittered
+func retryDelay(attempt int) time.Duration {
+	d := RETRY_BASE_DELAY << attempt
+	if d <= 0 || d > RETRY_MAX_DELAY {
+		d = RETRY_MAX_DELAY
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// call fn, then retry it up to opt.retries times while it fails with a retryable error
+func withRetries(opt *collect_options, what string, fn func() error) error {
+	err := fn()
+	for attempt := 0; attempt < opt.retries && err != nil && isRetryable(err); attempt++ {
+		delay := retryDelay(attempt)
+		printInfo(fmt.Sprintf("Retrying %s in %s after: %s", what, delay.Round(time.Millisecond), err))
+		retrySleep(delay)
+		err = fn()
+	}
+	return err
+}
+
+// make sure opt.token is usable: fetch one (for IMDSv2), reusing a cached one until it is about to expire.
+// An empty token (IMDSv1 fallback) is cached too, so a daemon does not re-probe every poll.
+// A token is also kept in --token-cache-path, if set, so the next run can reuse it.
+//
+// With --imds-version=v1 no token is ever requested, and with v2 an empty token is an error.
+//
+// The token request is not retried here; fetchPath retries it along with the request that needs it.
+func ensureToken(opt *collect_options) error {
+	if opt.imdsVersion == IMDS_VERSION_V1 || tokenUsable(opt, opt.tokenExpires) || loadCachedToken(opt) {
+		return nil
+	}
+
+	token, err := fetchToken(opt.baseURL, opt.tokenTTL)
+	var statusErr *HTTPErrorStatusCode
+	if errors.As(err, &statusErr) && (statusErr.code == http.StatusForbidden || statusErr.code == http.StatusNotFound) {
+		// IMDSv2 is turned off here, or the instance predates it; fall back to IMDSv1 unless --imds-version=v2
+		if opt.imdsVersion == IMDS_VERSION_V2 {
+			return fmt.Errorf("%w: %s", errIMDSv2Unavailable, statusErr)
+		}
+		token, err = "", nil
+	}
+	if err != nil {
+		return err
+	}
+	if token == "" && opt.imdsVersion == IMDS_VERSION_V2 {
+		return errIMDSv2Unavailable
+	}
+	opt.token = token
+	opt.tokenExpires = time.Now().Add(opt.tokenTTL)
+	saveCachedToken(opt)
+	return nil
+}
+
+// whether a token that expires at `expires` can still be used.
+//
+// A token is refreshed once less than a quarter of its TTL (at most TOKEN_REFRESH_MARGIN) is left, so
+// long-running modes replace it before it lapses rather than waiting to be refused with a 401.
+func tokenUsable(opt *collect_options, expires time.Time) bool {
+	margin := min(opt.tokenTTL/4, TOKEN_REFRESH_MARGIN)
+	return time.Now().Before(expires.Add(-margin))
+}
+
+// GET a meta-data path with the cached token, retrying transient failures
+func fetchPath(opt *collect_options, path string) ([]byte, error) {
+	var body []byte
+	url := opt.baseURL + path
+	err := withRetries(opt, url, func() (err error) {
+		if err = ensureToken(opt); err != nil {
+			return err
+		}
+		body, err = fetchURL(url, opt.token)
+
+		// IMDS no longer accepts our token (it expired early, or IMDS restarted); get a new one and try once more
+		var statusErr *HTTPErrorStatusCode
+		if errors.As(err, &statusErr) && statusErr.code == http.StatusUnauthorized && opt.token != "" {
+			printInfo("Token was rejected; fetching a new one")
+			invalidateToken(opt)
+			if err = ensureToken(opt); err != nil {
+				return err
+			}
+			body, err = fetchURL(url, opt.token)
+		}
+		return err
+	})
+	return body, err
+}
+
+// like fetchPath, but a 404 means "not there right now" and returns a nil body instead of an error
+func fetchOptionalPath(opt *collect_options, path string) ([]byte, error) {
+	body, err := fetchPath(opt, path)
+	var statusErr *HTTPErrorStatusCode
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound {
+		return nil, nil
+	}
+	return body, err
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replace retrySleep with one that records delays instead of sleeping; restored at the end of the test
+func helpNoRetrySleep(t *testing.T) *[]time.Duration {
+	slept := []time.Duration{}
+	origRetrySleep := retrySleep
+	retrySleep = func(d time.Duration) { slept = append(slept, d) }
+	t.Cleanup(func() { retrySleep = origRetrySleep })
+	return &slept
+}
+
+// a connection error, as the HTTP client would return it
+func helpNetError(msg string) error {
+	return &url.Error{Op: "Get", URL: "http://169.254.169.254/", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New(msg)}}
+}
+
+func Test_isRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection error", err: helpNetError("connection refused"), want: true},
+		{name: "timeout", err: &url.Error{Op: "Get", URL: "http://169.254.169.254/", Err: context.DeadlineExceeded}, want: true},
+		{name: "not a network error", err: &url.Error{Op: "Get", URL: "::", Err: errors.New("missing protocol scheme")}, want: false},
+		{name: "our own error", err: errIMDSv2Unavailable, want: false},
+		{name: "500", err: &HTTPErrorStatusCode{code: 500}, want: true},
+		{name: "503", err: &HTTPErrorStatusCode{code: 503}, want: true},
+		{name: "429", err: &HTTPErrorStatusCode{code: 429}, want: true},
+		{name: "404", err: &HTTPErrorStatusCode{code: 404}, want: false},
+		{name: "401", err: &HTTPErrorStatusCode{code: 401}, want: false},
+		{name: "wrapped 400", err: fmt.Errorf("oops: %w", &HTTPErrorStatusCode{code: 400}), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_retryDelay(t *testing.T) {
+	for attempt := 0; attempt < 70; attempt++ {
+		d := RETRY_BASE_DELAY << attempt
+		if d <= 0 || d > RETRY_MAX_DELAY {
+			d = RETRY_MAX_DELAY
+		}
+		got := retryDelay(attempt)
+		if got < d/2 || got >= d {
+			t.Errorf("retryDelay(%d) = %s, want [%s, %s)", attempt, got, d/2, d)
+		}
+	}
+}
+
+func Test_withRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		retries   int
+		errs      []error // returned by successive calls; nil after they run out
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "success", retries: 3, errs: nil, wantCalls: 1},
+		{name: "recovers", retries: 3, errs: []error{helpNetError("reset"), &HTTPErrorStatusCode{code: 503}}, wantCalls: 3},
+		{name: "gives up", retries: 2, errs: []error{helpNetError("1"), helpNetError("2"), helpNetError("3"), helpNetError("4")}, wantCalls: 3, wantErr: true},
+		{name: "no retries", retries: 0, errs: []error{helpNetError("1")}, wantCalls: 1, wantErr: true},
+		{name: "not retryable", retries: 3, errs: []error{errors.New("1")}, wantCalls: 1, wantErr: true},
+		{name: "4xx is final", retries: 3, errs: []error{&HTTPErrorStatusCode{code: 404}}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slept := helpNoRetrySleep(t)
+			calls := 0
+			err := withRetries(&collect_options{retries: tt.retries}, "test", func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("withRetries() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("withRetries() called fn %d times, want %d", calls, tt.wantCalls)
+			}
+			if len(*slept) != calls-1 {
+				t.Errorf("withRetries() slept %d times, want %d", len(*slept), calls-1)
+			}
+		})
+	}
+}
+
+func Test_fetchPath(t *testing.T) {
+	helpNoRetrySleep(t)
+
+	t.Run("retries 5xx", func(t *testing.T) {
+		failures := 2
+		srv := helpMakeAServerWithRoutes(map[string]writerFunc{
+			DEFAULT_INSTANCE_ID_PATH: func(w http.ResponseWriter) {
+				if failures > 0 {
+					failures--
+					http.Error(w, "busy", http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprint(w, "i-jklmn")
+			},
+		})
+		defer srv.Close()
+		got, err := fetchPath(&collect_options{baseURL: srv.URL, retries: 3}, DEFAULT_INSTANCE_ID_PATH)
+		if err != nil || string(got) != "i-jklmn" {
+			t.Errorf("fetchPath() = %s, %v", got, err)
+		}
+	})
+
+	t.Run("refreshes a rejected token", func(t *testing.T) {
+		tokens := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, DEFAULT_TOKEN_PATH) {
+				tokens++
+				fmt.Fprintf(w, "token-%d", tokens)
+				return
+			}
+			if r.Header.Get("X-aws-ec2-metadata-token") != fmt.Sprintf("token-%d", tokens) || tokens < 2 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "i-jklmn")
+		}))
+		defer srv.Close()
+		opts := &collect_options{baseURL: srv.URL, retries: 0}
+		got, err := fetchPath(opts, DEFAULT_INSTANCE_ID_PATH)
+		if err != nil || string(got) != "i-jklmn" {
+			t.Errorf("fetchPath() = %s, %v", got, err)
+		}
+		if tokens != 2 || opts.token != "token-2" {
+			t.Errorf("fetchPath() fetched %d tokens and kept %q, want 2 and token-2", tokens, opts.token)
+		}
+	})
+
+	t.Run("token errors are retried", func(t *testing.T) {
+		failures := 1
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, DEFAULT_TOKEN_PATH) && failures > 0 {
+				failures--
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		}))
+		defer srv.Close()
+		if _, err := fetchPath(&collect_options{baseURL: srv.URL, retries: 1}, DEFAULT_INSTANCE_ID_PATH); err != nil {
+			t.Errorf("fetchPath() error = %v", err)
+		}
+	})
+
+	t.Run("token errors are retried once per attempt", func(t *testing.T) {
+		puts := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "PUT" {
+				puts++
+			}
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		}))
+		defer srv.Close()
+		if _, err := fetchPath(&collect_options{baseURL: srv.URL, retries: 3}, DEFAULT_INSTANCE_ID_PATH); err == nil {
+			t.Error("fetchPath() wanted an error")
+		}
+		if puts != 4 {
+			t.Errorf("fetchPath() asked for a token %d times, want 4", puts)
+		}
+	})
+
+	t.Run("optional 404", func(t *testing.T) {
+		srv := helpMakeAServerWithRoutes(map[string]writerFunc{})
+		defer srv.Close()
+		got, err := fetchOptionalPath(&collect_options{baseURL: srv.URL, retries: 3}, DEFAULT_SPOT_ACTION_PATH)
+		if got != nil || err != nil {
+			t.Errorf("fetchOptionalPath() = %v, %v; want nil, nil", got, err)
+		}
+	})
+}
+
+func Test_newIMDSHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "too late")
+	}))
+	defer srv.Close()
+
+	client := newIMDSHTTPClient(&collect_options{connectTimeout: time.Second, requestTimeout: 50 * time.Millisecond})
+	if _, err := client.Get(srv.URL); err == nil {
+		t.Error("newIMDSHTTPClient() did not time out a slow request")
+	}
+}
+
+func Test_ensureToken_imdsVersion(t *testing.T) {
+	helpNoRetrySleep(t)
+	v2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "test-token")
+	}))
+	defer v2.Close()
+	v1Only := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	defer v1Only.Close()
+
+	tests := []struct {
+		name        string
+		baseURL     string
+		imdsVersion string
+		wantToken   string
+		wantErr     error
+	}{
+		{name: "auto uses v2", baseURL: v2.URL, imdsVersion: IMDS_VERSION_AUTO, wantToken: "test-token"},
+		{name: "auto falls back to v1", baseURL: v1Only.URL, imdsVersion: IMDS_VERSION_AUTO, wantToken: ""},
+		{name: "v2 uses v2", baseURL: v2.URL, imdsVersion: IMDS_VERSION_V2, wantToken: "test-token"},
+		{name: "v2 refuses v1", baseURL: v1Only.URL, imdsVersion: IMDS_VERSION_V2, wantErr: errIMDSv2Unavailable},
+		{name: "v1 never asks", baseURL: "http://127.0.0.1:99999", imdsVersion: IMDS_VERSION_V1, wantToken: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &collect_options{baseURL: tt.baseURL, imdsVersion: tt.imdsVersion}
+			err := ensureToken(opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ensureToken() error = %v, want %v", err, tt.wantErr)
+			}
+			if opts.token != tt.wantToken {
+				t.Errorf("ensureToken() token = %q, want %q", opts.token, tt.wantToken)
+			}
+		})
+	}
+}
+
+func Test_fetchPath_imdsV2Unavailable(t *testing.T) {
+	slept := helpNoRetrySleep(t)
+	puts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			puts++
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "i-jklmn")
+	}))
+	defer srv.Close()
+
+	_, err := fetchPath(&collect_options{baseURL: srv.URL, imdsVersion: IMDS_VERSION_V2, retries: 3}, DEFAULT_INSTANCE_ID_PATH)
+	if !errors.Is(err, errIMDSv2Unavailable) || !strings.Contains(err.Error(), "403") {
+		t.Errorf("fetchPath() error = %v, want %v with the status", err, errIMDSv2Unavailable)
+	}
+	if puts != 1 || len(*slept) != 0 {
+		t.Errorf("fetchPath() asked for a token %d times and slept %d times, want 1 and 0", puts, len(*slept))
+	}
+}
+
+func Test_fetchMetadata_imdsVersion(t *testing.T) {
+	srv := helpMakeAServer(
+		func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+		func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+	)
+	defer srv.Close()
+
+	for version, want := range map[string]int{IMDS_VERSION_AUTO: 2, IMDS_VERSION_V1: 1} {
+		got, err := fetchMetadata(&collect_options{baseURL: srv.URL, imdsVersion: version})
+		if err != nil {
+			t.Fatalf("fetchMetadata() error = %v", err)
+		}
+		if got.imdsVersion != want {
+			t.Errorf("--imds-version=%s: fetchMetadata().imdsVersion = %d, want %d", version, got.imdsVersion, want)
+		}
+	}
+}
+
+func Test_newIMDSHTTPClient_proxy(t *testing.T) {
+	proxied := false
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = true
+		http.Error(w, "proxy says no", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "direct")
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		useProxy    bool
+		wantProxied bool
+	}{
+		{name: "bypass by default", useProxy: false, wantProxied: false},
+		{name: "--imds-use-proxy", useProxy: true, wantProxied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxied = false
+			client := newIMDSHTTPClient(&collect_options{connectTimeout: time.Second, requestTimeout: time.Second, imdsUseProxy: tt.useProxy})
+			// the environment is only read once per process, so point the proxy function at our stand-in directly
+			if tt.useProxy {
+				if client.Transport.(*http.Transport).Proxy == nil {
+					t.Fatal("newIMDSHTTPClient() ignores the environment proxy with --imds-use-proxy")
+				}
+				client.Transport.(*http.Transport).Proxy = func(*http.Request) (*url.URL, error) { return url.Parse(proxy.URL) }
+			}
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if proxied != tt.wantProxied {
+				t.Errorf("request went through the proxy: %v, want %v", proxied, tt.wantProxied)
+			}
+		})
+	}
+
+	// with a proxy in the environment, the default client still connects directly
+	t.Setenv("HTTP_PROXY", proxy.URL)
+	client := newIMDSHTTPClient(&collect_options{connectTimeout: time.Second, requestTimeout: time.Second})
+	if client.Transport.(*http.Transport).Proxy != nil {
+		t.Error("newIMDSHTTPClient() uses a proxy without --imds-use-proxy")
+	}
+}
+
+func Test_tokenUsable(t *testing.T) {
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		expires time.Duration // from now
+		want    bool
+	}{
+		{name: "fresh 6h token", ttl: 6 * time.Hour, expires: 6 * time.Hour, want: true},
+		{name: "6h token with 6m left", ttl: 6 * time.Hour, expires: 6 * time.Minute, want: true},
+		{name: "6h token with 4m left", ttl: 6 * time.Hour, expires: 4 * time.Minute, want: false},
+		{name: "1m token with 20s left", ttl: time.Minute, expires: 20 * time.Second, want: true},
+		{name: "1m token with 10s left", ttl: time.Minute, expires: 10 * time.Second, want: false},
+		{name: "expired", ttl: time.Minute, expires: -time.Second, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tokenUsable(&collect_options{tokenTTL: tt.ttl}, time.Now().Add(tt.expires))
+			if got != tt.want {
+				t.Errorf("tokenUsable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ensureToken_ttl(t *testing.T) {
+	ttls := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ttls = append(ttls, r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+		fmt.Fprintf(w, "token-%d", len(ttls))
+	}))
+	defer srv.Close()
+
+	opts := &collect_options{baseURL: srv.URL, tokenTTL: 2 * time.Second}
+	if err := ensureToken(opts); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ttls, []string{"2"}) {
+		t.Errorf("ensureToken() asked for TTLs %v, want [2]", ttls)
+	}
+
+	// still good, so reused
+	if err := ensureToken(opts); err != nil || len(ttls) != 1 {
+		t.Errorf("ensureToken() = %v after %d token requests, want reuse", err, len(ttls))
+	}
+
+	// refreshed before it lapses, as a daemon would on its next poll: 0.4s left is inside the 0.5s margin
+	opts.tokenExpires = time.Now().Add(400 * time.Millisecond)
+	if err := ensureToken(opts); err != nil || len(ttls) != 2 || opts.token != "token-2" {
+		t.Errorf("ensureToken() = %v after %d token requests with %s, want a refresh", err, len(ttls), opts.token)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+const FORMAT_JSON = "json"
+const JSON_CONTENT_TYPE = "application/json"
+
+// the --format=json document: the fetched metadata, with times parsed and what is derived from them
+type json_document struct {
+	FetchedAt               time.Time     `json:"fetched_at"`
+	InstanceID              string        `json:"instance_id"`
+	Instance                json_instance `json:"instance"`
+	IMDSVersion             int           `json:"imds_version"`
+	MaintenanceWindowActive bool          `json:"maintenance_window_active"`
+	Events                  []json_event  `json:"events"`
+	SpotAction              *json_spot    `json:"spot_action"`              // null unless a spot interruption is pending
+	RebalanceRecommendedAt  *time.Time    `json:"rebalance_recommended_at"` // null unless EC2 has recommended a rebalance
+	AutoscalingState        string        `json:"autoscaling_target_lifecycle_state,omitempty"`
+}
+
+type json_instance struct {
+	InstanceType     string            `json:"instance_type"`
+	AvailabilityZone string            `json:"availability_zone"`
+	Region           string            `json:"region"`
+	AMIID            string            `json:"ami_id"`
+	LifeCycle        string            `json:"instance_life_cycle"`
+	AccountID        string            `json:"account_id"`
+	Tags             map[string]string `json:"tags"` // only the --instance-tags keys
+}
+
+type json_event struct {
+	EventID           string     `json:"event_id"`
+	Code              string     `json:"code"`
+	State             string     `json:"state"`
+	Description       string     `json:"description"`
+	NotBefore         time.Time  `json:"not_before"`
+	NotAfter          *time.Time `json:"not_after"`      // null if the event has no NotAfter
+	WindowSeconds     *int64     `json:"window_seconds"` // null if the event has no NotAfter
+	SecondsUntilStart int64      `json:"seconds_until_start"`
+	InWindow          bool       `json:"in_window"`
+}
+
+type json_spot struct {
+	Action   string    `json:"action"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// build the --format=json document, with times relative to `now`
+func newJSONDocument(metadata *fetched_metadata, now time.Time) (*json_document, error) {
+	doc := &json_document{
+		FetchedAt:  now.UTC().Truncate(time.Second),
+		InstanceID: metadata.instanceID,
+		Instance: json_instance{
+			InstanceType:     metadata.identity.InstanceType,
+			AvailabilityZone: metadata.identity.AvailabilityZone,
+			Region:           metadata.identity.Region,
+			AMIID:            metadata.identity.ImageId,
+			LifeCycle:        metadata.lifeCycle,
+			AccountID:        metadata.identity.AccountId,
+			Tags:             map[string]string{},
+		},
+		IMDSVersion:      metadata.imdsVersion,
+		Events:           []json_event{},
+		AutoscalingState: metadata.lifecycleState,
+	}
+	for _, tag := range metadata.tags {
+		doc.Instance.Tags[tag.key] = tag.value
+	}
+
+	for _, ev := range metadata.events {
+		event, err := newJSONEvent(ev, now)
+		if err != nil {
+			return nil, err
+		}
+		doc.Events = append(doc.Events, event)
+		doc.MaintenanceWindowActive = doc.MaintenanceWindowActive || event.InWindow
+	}
+
+	if metadata.spotAction != nil {
+		deadline, err := time.Parse(time.RFC3339, metadata.spotAction.Time)
+		if err != nil {
+			return nil, err
+		}
+		doc.SpotAction = &json_spot{Action: metadata.spotAction.Action, Deadline: deadline}
+	}
+
+	if metadata.rebalance != nil {
+		noticeTime, err := time.Parse(time.RFC3339, metadata.rebalance.NoticeTime)
+		if err != nil {
+			return nil, err
+		}
+		doc.RebalanceRecommendedAt = &noticeTime
+	}
+	return doc, nil
+}
+
+// an event with its times parsed, relative to `now`
+func newJSONEvent(ev maintenance_event, now time.Time) (json_event, error) {
+	notBefore, notAfter, err := parseEventWindow(ev)
+	if err != nil {
+		return json_event{}, err
+	}
+	inWindow, _ := inEventWindow(ev, now) // already parsed above
+	event := json_event{
+		EventID:           ev.EventId,
+		Code:              ev.Code,
+		State:             ev.State,
+		Description:       ev.Description,
+		NotBefore:         notBefore,
+		SecondsUntilStart: int64(notBefore.Sub(now).Seconds()),
+		InWindow:          inWindow,
+	}
+	if !notAfter.IsZero() {
+		window := int64(notAfter.Sub(notBefore).Seconds())
+		event.NotAfter, event.WindowSeconds = &notAfter, &window
+	}
+	return event, nil
+}
+
+// write the metadata as an indented JSON document
+func writeJSON(writer io.Writer, metadata *fetched_metadata) error {
+	doc, err := newJSONDocument(metadata, time.Now())
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(doc)
+}
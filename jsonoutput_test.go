@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func Test_newJSONDocument(t *testing.T) {
+	now := time.Date(2020, 1, 20, 10, 0, 0, 0, time.UTC)
+	metadata := &fetched_metadata{
+		instanceID:  "i-jklmn",
+		identity:    instance_identity{InstanceType: "m5.large", Region: "us-east-1"},
+		tags:        []instance_tag{{key: "cluster", value: "a"}},
+		imdsVersion: 2,
+		events: []maintenance_event{
+			{EventId: "ev-1", Code: "system-reboot", State: "active", Description: "scheduled reboot",
+				NotBefore: "20 Jan 2020 09:00:00 GMT", NotAfter: "20 Jan 2020 11:00:00 GMT"},
+			{EventId: "ev-2", Code: "instance-stop", State: "active", NotBefore: "21 Jan 2020 10:00:00 GMT"},
+		},
+		spotAction: &spot_instance_action{Action: "terminate", Time: "2020-01-20T10:02:00Z"},
+	}
+
+	doc, err := newJSONDocument(metadata, now)
+	if err != nil {
+		t.Fatalf("newJSONDocument() error = %v", err)
+	}
+	if !doc.MaintenanceWindowActive {
+		t.Error("MaintenanceWindowActive = false, want true")
+	}
+	if ev := doc.Events[0]; !ev.InWindow || ev.SecondsUntilStart != -3600 || *ev.WindowSeconds != 7200 {
+		t.Errorf("Events[0] = %+v", ev)
+	}
+	if ev := doc.Events[1]; ev.InWindow || ev.SecondsUntilStart != 86400 || ev.NotAfter != nil || ev.WindowSeconds != nil {
+		t.Errorf("Events[1] = %+v", ev)
+	}
+	if doc.SpotAction == nil || doc.SpotAction.Deadline.Sub(now) != 2*time.Minute {
+		t.Errorf("SpotAction = %+v", doc.SpotAction)
+	}
+	if doc.RebalanceRecommendedAt != nil {
+		t.Errorf("RebalanceRecommendedAt = %v, want nil", doc.RebalanceRecommendedAt)
+	}
+	if doc.Instance.Tags["cluster"] != "a" {
+		t.Errorf("Instance.Tags = %v", doc.Instance.Tags)
+	}
+
+	metadata.events[1].NotBefore = "tomorrow"
+	if _, err := newJSONDocument(metadata, now); err == nil {
+		t.Error("newJSONDocument() with a bad NotBefore, wanted an error")
+	}
+}
+
+func Test_writeJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, &fetched_metadata{instanceID: "i-jklmn"}); err != nil {
+		t.Fatalf("writeJSON() error = %v", err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("writeJSON() wrote invalid JSON: %v\n%s", err, buf.String())
+	}
+	// no events is an empty list and no spot action is null, so scripts don't have to tell them apart
+	if events, ok := got["events"].([]any); !ok || len(events) != 0 {
+		t.Errorf("events = %v, want []", got["events"])
+	}
+	if spot, ok := got["spot_action"]; !ok || spot != nil {
+		t.Errorf("spot_action = %v, want null", spot)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// what a notice is about
+const NOTICE_NEW = "new"                 // the event was seen for the first time
+const NOTICE_RESCHEDULED = "rescheduled" // its NotBefore or NotAfter moved since the last notice
+const NOTICE_IN_WINDOW = "in_window"     // its window has started
+const NOTICE_CANCELED = "canceled"       // AWS canceled it, after it was announced
+
+const NOTIFY_TIMEOUT = 10 * time.Second
+const NOTIFY_LEDGER_MODE = 0600
+
+// for notifications, which go out to other services; unlike IMDS requests these honor HTTP_PROXY
+var notifyHTTPClient = &http.Client{Timeout: NOTIFY_TIMEOUT}
+
+var errNotifyLedgerPathRequired = errors.New("--webhook-url and --slack-* need --notify-ledger-path, to send each notice once")
+
+// something that tells people about maintenance events
+type notifier interface {
+	// for the log, and to keep each notifier's notices apart in the ledger
+	name() string
+	// the NOTICE_ kinds it sends; others are left out
+	kinds() []string
+	// send one notice; may set entry.Thread
+	notify(opt *collect_options, notice event_notice, entry *notified_event) error
+}
+
+// one notice about one event
+type event_notice struct {
+	Kind              string     `json:"kind"` // NOTICE_NEW, etc.
+	SentAt            time.Time  `json:"sent_at"`
+	InstanceID        string     `json:"instance_id"`
+	Event             json_event `json:"event"`
+	PreviousNotBefore *time.Time `json:"previous_not_before,omitempty"` // with NOTICE_RESCHEDULED
+	PreviousNotAfter  *time.Time `json:"previous_not_after,omitempty"`  // with NOTICE_RESCHEDULED, if there was one
+}
+
+// the notices sent for an event, and the window they told people about
+type notified_event struct {
+	NotBefore string               `json:"not_before"`
+	NotAfter  string               `json:"not_after"`
+	Sent      map[string]time.Time `json:"sent"`             // by notice kind, when it was last sent
+	Thread    string               `json:"thread,omitempty"` // where the notifier's later notices go, e.g. Slack's thread
+}
+
+// by notifier name, then event id; kept in --notify-ledger-path so each notice is sent once
+type notify_ledger map[string]map[string]*notified_event
+
+// the notifiers the options ask for
+func newNotifiers(opt *collect_options) ([]notifier, error) {
+	var ret []notifier
+	if opt.webhookURL != "" {
+		webhook, err := newWebhookNotifier(opt)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, webhook)
+	}
+	if opt.slackWebhookURL != "" || opt.slackWebhookURLFile != "" || opt.slackTokenFile != "" {
+		slack, err := newSlackNotifier(opt)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, slack)
+	}
+	return ret, nil
+}
+
+// send each notifier the notices that are due: an event is new, was rescheduled, its window started, or
+// it was canceled.
+//
+// A notice is recorded in the ledger once it has been sent; one that fails (after retries) is logged
+// and tried again next time, and the event's later notices wait for it, so they arrive in order. An
+// error is only returned when the ledger can't be read or written.
+func runNotifiers(opt *collect_options, metadata *fetched_metadata) error {
+	notifiers, err := newNotifiers(opt)
+	if err != nil || len(notifiers) == 0 {
+		return err
+	}
+	ledger := notify_ledger{}
+	if err := loadStateFile(opt.notifyLedgerPath, &ledger); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, n := range notifiers {
+		if ledger[n.name()] == nil {
+			ledger[n.name()] = map[string]*notified_event{}
+		}
+		notified := ledger[n.name()]
+
+		listed := map[string]bool{}
+		for _, ev := range metadata.events {
+			listed[ev.EventId] = true
+			if notified[ev.EventId] == nil {
+				notified[ev.EventId] = &notified_event{Sent: map[string]time.Time{}}
+			}
+			entry := notified[ev.EventId]
+
+			notices, err := dueNotices(entry, ev, metadata.instanceID, now)
+			if err != nil {
+				return err
+			}
+			for _, notice := range notices {
+				if !slices.Contains(n.kinds(), notice.Kind) {
+					continue
+				}
+				if err := n.notify(opt, notice, entry); err != nil {
+					printError(fmt.Errorf("%s %s notice for %s: %w", n.name(), notice.Kind, ev.EventId, err))
+					break
+				}
+				printInfo(fmt.Sprintf("Sent %s %s notice for %s", n.name(), notice.Kind, ev.EventId))
+				entry.Sent[notice.Kind] = now
+				// the window the receiver has been told about, so the next change to it is reported
+				if notice.Kind == NOTICE_NEW || notice.Kind == NOTICE_RESCHEDULED {
+					entry.NotBefore, entry.NotAfter = ev.NotBefore, ev.NotAfter
+				}
+				if err := saveStateFile(opt.notifyLedgerPath, NOTIFY_LEDGER_MODE, ledger); err != nil {
+					return err
+				}
+			}
+		}
+
+		// forget events AWS no longer lists
+		for id := range notified {
+			if !listed[id] {
+				delete(notified, id)
+			}
+		}
+	}
+	return saveStateFile(opt.notifyLedgerPath, NOTIFY_LEDGER_MODE, ledger)
+}
+
+// the notices due for an event, given what was sent before. A canceled event gets NOTICE_CANCELED if it
+// was announced (for the notifiers whose kinds() include it), and completed events get none.
+func dueNotices(entry *notified_event, ev maintenance_event, instanceID string, now time.Time) ([]event_notice, error) {
+	if ev.State == "completed" {
+		return nil, nil
+	}
+	event, err := newJSONEvent(ev, now)
+	if err != nil {
+		return nil, err
+	}
+	notice := func(kind string) event_notice {
+		return event_notice{Kind: kind, SentAt: now.UTC().Truncate(time.Second), InstanceID: instanceID, Event: event}
+	}
+
+	_, announced := entry.Sent[NOTICE_NEW]
+	if ev.State == "canceled" {
+		if _, ok := entry.Sent[NOTICE_CANCELED]; announced && !ok {
+			return []event_notice{notice(NOTICE_CANCELED)}, nil
+		}
+		return nil, nil
+	}
+
+	var ret []event_notice
+	if !announced {
+		ret = append(ret, notice(NOTICE_NEW))
+	} else if entry.NotBefore != ev.NotBefore || entry.NotAfter != ev.NotAfter {
+		rescheduled := notice(NOTICE_RESCHEDULED)
+		previous := maintenance_event{NotBefore: entry.NotBefore, NotAfter: entry.NotAfter}
+		if notBefore, notAfter, err := parseEventWindow(previous); err == nil {
+			rescheduled.PreviousNotBefore = &notBefore
+			if !notAfter.IsZero() {
+				rescheduled.PreviousNotAfter = &notAfter
+			}
+		}
+		ret = append(ret, rescheduled)
+	}
+	if _, ok := entry.Sent[NOTICE_IN_WINDOW]; !ok && event.InWindow {
+		ret = append(ret, notice(NOTICE_IN_WINDOW))
+	}
+	return ret, nil
+}
+
+// POST a JSON body, returning the response body; a response other than 2xx is an *HTTPErrorStatusCode,
+// so withRetries retries 429 and 5xx.
+//
+// Errors name the request by `label` instead of its URL, since a webhook URL is often a credential
+// and the errors are logged.
+func postJSON(target, label string, body []byte, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid URL", label)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyHTTPClient.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = label
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &HTTPErrorStatusCode{url: label, code: resp.StatusCode, message: resp.Status}
+	}
+	return respBody, err
+}
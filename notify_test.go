@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_dueNotices(t *testing.T) {
+	now := time.Date(2020, 1, 20, 10, 0, 0, 0, time.UTC)
+	sent := func(kinds ...string) map[string]time.Time {
+		ret := map[string]time.Time{}
+		for _, kind := range kinds {
+			ret[kind] = now.Add(-time.Hour)
+		}
+		return ret
+	}
+	upcoming := maintenance_event{EventId: "ev-1", State: "active", NotBefore: "21 Jan 2020 09:00:00 GMT", NotAfter: "21 Jan 2020 11:00:00 GMT"}
+	started := maintenance_event{EventId: "ev-1", State: "active", NotBefore: "20 Jan 2020 09:00:00 GMT", NotAfter: "20 Jan 2020 11:00:00 GMT"}
+	tests := []struct {
+		name              string
+		entry             *notified_event
+		ev                maintenance_event
+		want              []string
+		wantPreviousStart string
+	}{
+		{name: "new",
+			entry: &notified_event{Sent: sent()},
+			ev:    upcoming,
+			want:  []string{NOTICE_NEW}},
+		{name: "already sent",
+			entry: &notified_event{NotBefore: upcoming.NotBefore, NotAfter: upcoming.NotAfter, Sent: sent(NOTICE_NEW)},
+			ev:    upcoming,
+			want:  nil},
+		{name: "rescheduled",
+			entry:             &notified_event{NotBefore: "19 Jan 2020 09:00:00 GMT", NotAfter: upcoming.NotAfter, Sent: sent(NOTICE_NEW)},
+			ev:                upcoming,
+			want:              []string{NOTICE_RESCHEDULED},
+			wantPreviousStart: "2020-01-19T09:00:00Z"},
+		{name: "new and already in window",
+			entry: &notified_event{Sent: sent()},
+			ev:    started,
+			want:  []string{NOTICE_NEW, NOTICE_IN_WINDOW}},
+		{name: "window started",
+			entry: &notified_event{NotBefore: started.NotBefore, NotAfter: started.NotAfter, Sent: sent(NOTICE_NEW)},
+			ev:    started,
+			want:  []string{NOTICE_IN_WINDOW}},
+		{name: "canceled after it was announced",
+			entry: &notified_event{NotBefore: upcoming.NotBefore, NotAfter: upcoming.NotAfter, Sent: sent(NOTICE_NEW)},
+			ev:    maintenance_event{EventId: "ev-1", State: "canceled", NotBefore: upcoming.NotBefore, NotAfter: upcoming.NotAfter},
+			want:  []string{NOTICE_CANCELED}},
+		{name: "canceled, already said so",
+			entry: &notified_event{NotBefore: upcoming.NotBefore, NotAfter: upcoming.NotAfter, Sent: sent(NOTICE_NEW, NOTICE_CANCELED)},
+			ev:    maintenance_event{EventId: "ev-1", State: "canceled", NotBefore: upcoming.NotBefore, NotAfter: upcoming.NotAfter},
+			want:  nil},
+		{name: "canceled before it was announced",
+			entry: &notified_event{Sent: sent()},
+			ev:    maintenance_event{EventId: "ev-1", State: "canceled", NotBefore: upcoming.NotBefore, NotAfter: upcoming.NotAfter},
+			want:  nil},
+		{name: "completed",
+			entry: &notified_event{Sent: sent()},
+			ev:    maintenance_event{EventId: "ev-1", State: "completed", NotBefore: "20 Jan 2020 09:00:00 GMT"},
+			want:  nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notices, err := dueNotices(tt.entry, tt.ev, "i-jklmn", now)
+			if err != nil {
+				t.Fatalf("dueNotices() error = %v", err)
+			}
+			var got []string
+			for _, notice := range notices {
+				got = append(got, notice.Kind)
+				if notice.InstanceID != "i-jklmn" || notice.Event.EventID != "ev-1" {
+					t.Errorf("notice = %+v", notice)
+				}
+				if notice.Kind == NOTICE_RESCHEDULED && notice.PreviousNotBefore.Format(time.RFC3339) != tt.wantPreviousStart {
+					t.Errorf("PreviousNotBefore = %v, want %s", notice.PreviousNotBefore, tt.wantPreviousStart)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dueNotices() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_postJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Test") != "yes" {
+			http.Error(w, "bad request", 400)
+			return
+		}
+		if r.URL.Path == "/busy" {
+			http.Error(w, "busy", 503)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer srv.Close()
+	header := http.Header{"X-Test": {"yes"}}
+
+	body, err := postJSON(srv.URL, "test", []byte("{}"), header)
+	if err != nil || string(body) != `{"ok":true}` {
+		t.Errorf("postJSON() = %s, %v", body, err)
+	}
+
+	var statusErr *HTTPErrorStatusCode
+	_, err = postJSON(srv.URL+"/busy?secret=s3cret", "test", []byte("{}"), header)
+	if !errors.As(err, &statusErr) || statusErr.code != 503 {
+		t.Errorf("postJSON() error = %v, want a 503", err)
+	}
+
+	// the URL may be a credential, so errors leave it out; a connection error is still retryable
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("postJSON() error = %v, shows the URL", err)
+	}
+	srv.Close()
+	_, err = postJSON(srv.URL+"/hooks?secret=s3cret", "test", []byte("{}"), header)
+	if err == nil || strings.Contains(err.Error(), "s3cret") || !isRetryable(err) {
+		t.Errorf("postJSON() to a closed server error = %v, want a retryable one without the URL", err)
+	}
+	if _, err := postJSON("http://bad host/?secret=s3cret", "test", nil, nil); err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("postJSON() to a bad URL error = %v, want one without the URL", err)
+	}
+}
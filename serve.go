@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+const OPENMETRICS_CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+var errNoMetricsYet = errors.New("no metrics collected yet")
+
+// holds the most recently collected metrics for serve, and whether collecting them worked
+type metrics_exporter struct {
+	mu          sync.RWMutex
+	contentType string
+	metrics     []byte
+	lastErr     error
+	lastFetch   time.Time
+}
+
+// fetch metadata and render it as metrics, keeping the previous metrics if the fetch fails
+//
+// has the signature runDaemon expects, so serve can poll on the same schedule as --daemon
+func (e *metrics_exporter) collect(ctx context.Context, opt *collect_options) error {
+	var buf bytes.Buffer
+	fetchedMetadata, err := fetchMetadata(opt)
+	if err == nil {
+		if _, err := trackEvents(opt, fetchedMetadata); err != nil {
+			printError(err) // still serve the metrics, without the change counters
+		}
+		err = writeOutput(&buf, fetchedMetadata, opt)
+	}
+
+	e.mu.Lock()
+	e.lastErr = err
+	if err == nil {
+		e.metrics = buf.Bytes()
+		switch opt.format {
+		case FORMAT_OPENMETRICS:
+			e.contentType = OPENMETRICS_CONTENT_TYPE
+		case FORMAT_JSON:
+			e.contentType = JSON_CONTENT_TYPE
+		default:
+			e.contentType = METRICS_CONTENT_TYPE
+		}
+		e.lastFetch = time.Now()
+	}
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// after updating the metrics, so a slow notifier or hook doesn't hold them up; the metrics are still
+	// good if they fail
+	if err := runNotifiers(opt, fetchedMetadata); err != nil {
+		printError(err)
+	}
+	if err := runHooks(ctx, opt, fetchedMetadata); err != nil {
+		printError(err)
+	}
+	return nil
+}
+
+func (e *metrics_exporter) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.metrics == nil {
+		http.Error(w, errNoMetricsYet.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", e.contentType)
+	w.Write(e.metrics)
+}
+
+// 200 if the last IMDS fetch succeeded, 503 (with the error) if it did not or none has finished yet
+func (e *metrics_exporter) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	switch {
+	case e.lastErr != nil:
+		http.Error(w, e.lastErr.Error(), http.StatusServiceUnavailable)
+	case e.metrics == nil:
+		http.Error(w, errNoMetricsYet.Error(), http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintf(w, "ok, last fetch %s\n", e.lastFetch.UTC().Format(time.RFC3339))
+	}
+}
+
+// wrap next so it requires the given basic auth credentials
+func requireBasicAuth(user, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPassword, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(gotUser), []byte(user)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(gotPassword), []byte(password)) == 1
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+MY_PROGRAM_NAME+`"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routes for serve. /healthz is left unauthenticated so load balancers and systemd checks can use it.
+func newServeMux(e *metrics_exporter, opt *collect_options) (*http.ServeMux, error) {
+	var metricsHandler http.Handler = http.HandlerFunc(e.handleMetrics)
+	if opt.basicAuthUser != "" {
+		password, err := os.ReadFile(opt.basicAuthPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		metricsHandler = requireBasicAuth(opt.basicAuthUser, strings.TrimSpace(string(password)), metricsHandler)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", e.handleHealthz)
+	return mux, nil
+}
+
+// serve metrics over HTTP(S) and poll IMDS in the background until ctx is done
+func runServer(ctx context.Context, opt *collect_options) error {
+	exporter := &metrics_exporter{}
+	mux, err := newServeMux(exporter, opt)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Addr: opt.listenAddress, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if opt.tlsCertFile != "" {
+			serveErr <- srv.ListenAndServeTLS(opt.tlsCertFile, opt.tlsKeyFile)
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	printInfo(fmt.Sprintf("Serving metrics on %s", opt.listenAddress))
+
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	defer stopPolling()
+	polled := make(chan struct{})
+	go func() {
+		runDaemon(pollCtx, opt, exporter.collect)
+		close(polled)
+	}()
+
+	select {
+	case err = <-serveErr:
+		// the listener failed (e.g. address in use); stop polling and report it
+		stopPolling()
+		<-polled
+		return err
+	case <-ctx.Done():
+	}
+	<-polled
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_metrics_exporter(t *testing.T) {
+	healthy := true
+	srv := helpMakeAServer(
+		func(w http.ResponseWriter) {
+			if !healthy {
+				http.Error(w, "meta-data unavailable", 500)
+				return
+			}
+			fmt.Fprint(w, "i-jklmn")
+		},
+		func(w http.ResponseWriter) {
+			data, _ := json.Marshal([]maintenance_event{{EventId: "ev-ent1", NotBefore: "20 Jan 2019 09:00:43 GMT"}})
+			fmt.Fprint(w, string(data))
+		},
+	)
+	defer srv.Close()
+
+	opts := &collect_options{baseURL: srv.URL, metricPrefix: "amcs_"}
+	exporter := &metrics_exporter{}
+	mux, err := newServeMux(exporter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		body, _ := io.ReadAll(rec.Body)
+		return rec.Code, string(body)
+	}
+
+	// nothing collected yet
+	if code, _ := get("/metrics"); code != http.StatusServiceUnavailable {
+		t.Errorf("/metrics before collecting = %d, want 503", code)
+	}
+	if code, _ := get("/healthz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz before collecting = %d, want 503", code)
+	}
+
+	// good collection
+	if err := exporter.collect(context.Background(), opts); err != nil {
+		t.Fatalf("collect() error = %v", err)
+	}
+	code, body := get("/metrics")
+	if code != http.StatusOK || !strings.Contains(body, `amcs_aws_maintenance_event_count{cloud_instance="i-jklmn"} 1`) {
+		t.Errorf("/metrics = %d `%s`", code, body)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz after a good fetch = %d, want 200", code)
+	}
+
+	// failed collection keeps serving the last metrics, but is unhealthy
+	healthy = false
+	if err := exporter.collect(context.Background(), opts); err == nil {
+		t.Fatal("collect() wanted an error")
+	}
+	if code, body := get("/metrics"); code != http.StatusOK || !strings.Contains(body, "i-jklmn") {
+		t.Errorf("/metrics after a failed fetch = %d `%s`", code, body)
+	}
+	if code, body := get("/healthz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "500") {
+		t.Errorf("/healthz after a failed fetch = %d `%s`", code, body)
+	}
+}
+
+func Test_metrics_exporter_openmetrics(t *testing.T) {
+	srv := helpMakeAServer(
+		func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+		func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+	)
+	defer srv.Close()
+
+	opts := &collect_options{baseURL: srv.URL, format: FORMAT_OPENMETRICS}
+	exporter := &metrics_exporter{}
+	if err := exporter.collect(context.Background(), opts); err != nil {
+		t.Fatalf("collect() error = %v", err)
+	}
+	rec := httptest.NewRecorder()
+	exporter.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Header().Get("Content-Type"); got != OPENMETRICS_CONTENT_TYPE {
+		t.Errorf("Content-Type = %s, want %s", got, OPENMETRICS_CONTENT_TYPE)
+	}
+	if body := rec.Body.String(); !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("/metrics = `%s`, want it to end with # EOF", body)
+	}
+}
+
+func Test_newServeMux_basicAuth(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	os.WriteFile(passwordFile, []byte("s3cret\n"), 0600)
+
+	exporter := &metrics_exporter{metrics: []byte("ok 1\n")}
+	opts := &collect_options{basicAuthUser: "prometheus", basicAuthPasswordFile: passwordFile}
+	mux, err := newServeMux(exporter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		path           string
+		user, password string
+		want           int
+	}{
+		{name: "no credentials", path: "/metrics", want: http.StatusUnauthorized},
+		{name: "wrong password", path: "/metrics", user: "prometheus", password: "nope", want: http.StatusUnauthorized},
+		{name: "good credentials", path: "/metrics", user: "prometheus", password: "s3cret", want: http.StatusOK},
+		{name: "healthz is open", path: "/healthz", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("GET %s = %d, want %d", tt.path, rec.Code, tt.want)
+			}
+		})
+	}
+
+	opts.basicAuthPasswordFile = filepath.Join(t.TempDir(), "missing")
+	if _, err := newServeMux(exporter, opts); err == nil {
+		t.Error("newServeMux() with a missing password file wanted an error")
+	}
+}
+
+func Test_runServer(t *testing.T) {
+	srv := helpMakeAServer(
+		func(w http.ResponseWriter) { fmt.Fprint(w, "i-jklmn") },
+		func(w http.ResponseWriter) { fmt.Fprint(w, "[]") },
+	)
+	defer srv.Close()
+
+	t.Run("stops when canceled", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		opts := &collect_options{baseURL: srv.URL, listenAddress: "127.0.0.1:0", interval: time.Millisecond}
+		if err := runServer(ctx, opts); err != nil {
+			t.Errorf("runServer() error = %v", err)
+		}
+	})
+
+	t.Run("bad listen address", func(t *testing.T) {
+		opts := &collect_options{baseURL: srv.URL, listenAddress: "not an address", interval: time.Minute}
+		if err := runServer(context.Background(), opts); err == nil {
+			t.Error("runServer() wanted an error")
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const COMMAND_SHOW = "show"
+
+// exit codes for show. A fatal error (e.g. IMDS unreachable) exits 1 through check().
+const SHOW_EXIT_NOTHING_PENDING = 0
+const SHOW_EXIT_PENDING = 2
+
+const SHOW_TIME_FORMAT = "Mon 2006-01-02 15:04 MST"
+
+// whether an event still needs attention: AWS hasn't marked it completed or canceled
+func eventPending(ev maintenance_event) bool {
+	return ev.State != "completed" && ev.State != "canceled"
+}
+
+// fetch metadata and print it for a person; returns whether anything is pending
+func runShow(writer io.Writer, opt *collect_options) (bool, error) {
+	fetchedMetadata, err := fetchMetadata(opt)
+	if err != nil {
+		return false, err
+	}
+	return writeShow(writer, fetchedMetadata, time.Now(), time.Local)
+}
+
+// print the instance, any spot interruption, and a table of scheduled events with their windows in
+// `loc` and UTC; returns whether any event is pending or a spot interruption is coming
+func writeShow(writer io.Writer, metadata *fetched_metadata, now time.Time, loc *time.Location) (bool, error) {
+	pending := false
+
+	fmt.Fprintf(writer, "Instance %s", metadata.instanceID)
+	if metadata.identity.InstanceType != "" {
+		fmt.Fprintf(writer, " (%s, %s)", metadata.identity.InstanceType, metadata.identity.AvailabilityZone)
+	}
+	fmt.Fprintln(writer)
+
+	if metadata.spotAction != nil {
+		deadline, err := time.Parse(time.RFC3339, metadata.spotAction.Time)
+		if err != nil {
+			return false, err
+		}
+		pending = true
+		fmt.Fprintf(writer, "Spot interruption: %s at %s (%s), in %s\n",
+			metadata.spotAction.Action,
+			deadline.In(loc).Format(SHOW_TIME_FORMAT),
+			deadline.UTC().Format(SHOW_TIME_FORMAT),
+			humanDuration(deadline.Sub(now)),
+		)
+	}
+
+	if len(metadata.events) == 0 {
+		fmt.Fprintln(writer, "No scheduled maintenance events.")
+		return pending, nil
+	}
+
+	type row struct {
+		ev                  maintenance_event
+		notBefore, notAfter time.Time
+	}
+	rows := make([]row, 0, len(metadata.events))
+	for _, ev := range metadata.events {
+		notBefore, notAfter, err := parseEventWindow(ev)
+		if err != nil {
+			return false, err
+		}
+		rows = append(rows, row{ev, notBefore, notAfter})
+	}
+	slices.SortStableFunc(rows, func(a, b row) int { return a.notBefore.Compare(b.notBefore) })
+
+	fmt.Fprintln(writer)
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "CODE\tSTATE\tWINDOW (LOCAL)\tWINDOW (UTC)\tREMAINING\tDESCRIPTION")
+	for _, r := range rows {
+		pending = pending || eventPending(r.ev)
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.ev.Code,
+			r.ev.State,
+			formatWindow(r.notBefore, r.notAfter, loc),
+			formatWindow(r.notBefore, r.notAfter, time.UTC),
+			remaining(r.ev, r.notBefore, r.notAfter, now),
+			strings.Join(strings.Fields(r.ev.Description), " "), // no tabs or newlines in the table
+		)
+	}
+	return pending, table.Flush()
+}
+
+// "Mon 2020-01-20 09:00 UTC - Mon 2020-01-20 11:00 UTC", or just the start and a dash with no NotAfter
+func formatWindow(notBefore, notAfter time.Time, loc *time.Location) string {
+	ret := notBefore.In(loc).Format(SHOW_TIME_FORMAT) + " -"
+	if !notAfter.IsZero() {
+		ret += " " + notAfter.In(loc).Format(SHOW_TIME_FORMAT)
+	}
+	return ret
+}
+
+// time until the window starts, or where the event is if it already has
+func remaining(ev maintenance_event, notBefore, notAfter time.Time, now time.Time) string {
+	switch inWindow, _ := inEventWindow(ev, now); {
+	case !eventPending(ev):
+		return "-"
+	case inWindow && !notAfter.IsZero():
+		return "in window, ends in " + humanDuration(notAfter.Sub(now))
+	case inWindow:
+		return "in window"
+	case now.Before(notBefore):
+		return humanDuration(notBefore.Sub(now))
+	default:
+		return "window passed"
+	}
+}
+
+// a rough duration for people: "2d 3h", "3h 20m", "12m", "<1m"
+func humanDuration(d time.Duration) string {
+	d = d.Truncate(time.Minute)
+	days, hours, minutes := int(d.Hours())/24, int(d.Hours())%24, int(d.Minutes())%60
+	switch {
+	case d < time.Minute:
+		return "<1m"
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_writeShow(t *testing.T) {
+	now := time.Date(2020, 1, 20, 10, 0, 0, 0, time.UTC)
+	berlin := time.FixedZone("CET", 3600)
+	tests := []struct {
+		name        string
+		metadata    *fetched_metadata
+		want        []string // each must match somewhere in the output
+		wantPending bool
+		wantErr     bool
+	}{
+		{name: "no events",
+			metadata:    &fetched_metadata{instanceID: "i-jklmn"},
+			want:        []string{`(?m)^Instance i-jklmn$`, `No scheduled maintenance events\.`},
+			wantPending: false,
+		},
+		{name: "pending event",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				identity: instance_identity{InstanceType: "m5.large", AvailabilityZone: "us-east-1a"},
+				events: []maintenance_event{{Code: "system-reboot", State: "active", Description: "scheduled\treboot",
+					NotBefore: "21 Jan 2020 12:30:00 GMT", NotAfter: "21 Jan 2020 14:30:00 GMT"}}},
+			want: []string{
+				`(?m)^Instance i-jklmn \(m5\.large, us-east-1a\)$`,
+				`(?m)^CODE +STATE +WINDOW \(LOCAL\) +WINDOW \(UTC\) +REMAINING +DESCRIPTION$`,
+				`(?m)^system-reboot +active +Tue 2020-01-21 13:30 CET - Tue 2020-01-21 15:30 CET +Tue 2020-01-21 12:30 UTC - Tue 2020-01-21 14:30 UTC +1d 2h +scheduled reboot$`,
+			},
+			wantPending: true,
+		},
+		{name: "in window, sorted by start",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				events: []maintenance_event{
+					{Code: "instance-stop", State: "active", NotBefore: "22 Jan 2020 09:00:00 GMT"},
+					{Code: "system-reboot", State: "active", NotBefore: "20 Jan 2020 09:00:00 GMT", NotAfter: "20 Jan 2020 10:45:00 GMT"},
+				}},
+			want:        []string{`(?s)system-reboot .* in window, ends in 45m .*\n.*instance-stop .* 1d 23h`},
+			wantPending: true,
+		},
+		{name: "completed events are not pending",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				events: []maintenance_event{
+					{Code: "system-reboot", State: "completed", NotBefore: "10 Jan 2020 09:00:00 GMT"},
+					{Code: "instance-reboot", State: "canceled", NotBefore: "30 Jan 2020 09:00:00 GMT"},
+				}},
+			want:        []string{`(?m)^system-reboot +completed .* - *$`},
+			wantPending: false,
+		},
+		{name: "spot interruption is pending",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				spotAction: &spot_instance_action{Action: "terminate", Time: "2020-01-20T10:02:00Z"}},
+			want:        []string{`(?m)^Spot interruption: terminate at Mon 2020-01-20 11:02 CET \(Mon 2020-01-20 10:02 UTC\), in 2m$`},
+			wantPending: true,
+		},
+		{name: "bad NotBefore",
+			metadata: &fetched_metadata{instanceID: "i-jklmn",
+				events: []maintenance_event{{State: "active", NotBefore: "soon"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			pending, err := writeShow(&buf, tt.metadata, now, berlin)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeShow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if pending != tt.wantPending {
+				t.Errorf("writeShow() pending = %v, want %v", pending, tt.wantPending)
+			}
+			for _, want := range tt.want {
+				if !regexp.MustCompile(want).MatchString(buf.String()) {
+					t.Errorf("writeShow() wrote\n%s\nwanted it to match %s", buf.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func Test_humanDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{-time.Hour, "<1m"},
+		{30 * time.Second, "<1m"},
+		{12*time.Minute + 59*time.Second, "12m"},
+		{3*time.Hour + 20*time.Minute, "3h 20m"},
+		{51*time.Hour + 5*time.Minute, "2d 3h"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := humanDuration(tt.d); got != tt.want {
+				t.Errorf("humanDuration(%s) = %s, want %s", tt.d, got, tt.want)
+			}
+		})
+	}
+}
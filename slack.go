@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Slack's Web API; a var so tests can point it at a stand-in
+var slackAPIURL = "https://slack.com/api/"
+
+// Slack also says when an announced event is canceled, so the thread isn't left hanging
+var SLACK_NOTICE_KINDS = []string{NOTICE_NEW, NOTICE_RESCHEDULED, NOTICE_IN_WINDOW, NOTICE_CANCELED}
+
+var errSlackChannelRequired = errors.New("--slack-token-file and --slack-channel go together")
+var errSlackWebhookOrToken = errors.New("use either --slack-webhook-url(-file), or --slack-token-file with --slack-channel, not both")
+var errSlackWebhookURLTwice = errors.New("--slack-webhook-url and --slack-webhook-url-file can't be used together")
+
+// posts each notice as a Block Kit message.
+//
+// With an incoming webhook every notice is a message of its own, since incoming webhooks can't reply in
+// threads or edit messages. With a bot token, later notices about an event are replies in the thread of
+// its first message, and that message is edited to show the event as it is now.
+type slack_notifier struct {
+	webhookURL string // a credential: anyone with it can post to the channel, so it is kept out of errors
+	token      string // with channel, instead of webhookURL
+	channel    string
+}
+
+// a message for an incoming webhook or chat.postMessage/chat.update
+type slack_message struct {
+	Channel  string        `json:"channel,omitempty"`
+	TS       string        `json:"ts,omitempty"`        // the message to edit, with chat.update
+	ThreadTS string        `json:"thread_ts,omitempty"` // the message to reply to
+	Text     string        `json:"text"`                // for notifications, and clients that can't show blocks
+	Blocks   []slack_block `json:"blocks"`
+}
+
+type slack_block struct {
+	Type     string       `json:"type"`
+	Text     *slack_text  `json:"text,omitempty"`
+	Fields   []slack_text `json:"fields,omitempty"`
+	Elements []slack_text `json:"elements,omitempty"` // for "context" blocks
+}
+
+type slack_text struct {
+	Type string `json:"type"` // "plain_text" or "mrkdwn"
+	Text string `json:"text"`
+}
+
+// what chat.postMessage and chat.update answer with; errors come back as 200 with ok false
+type slack_response struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"` // the channel's id, which chat.update needs
+	TS      string `json:"ts"`
+}
+
+func newSlackNotifier(opt *collect_options) (*slack_notifier, error) {
+	ret := &slack_notifier{webhookURL: opt.slackWebhookURL, channel: opt.slackChannel}
+	if opt.slackWebhookURLFile != "" {
+		webhookURL, err := os.ReadFile(opt.slackWebhookURLFile)
+		if err != nil {
+			return nil, err
+		}
+		ret.webhookURL = strings.TrimSpace(string(webhookURL))
+	}
+	if opt.slackTokenFile != "" {
+		token, err := os.ReadFile(opt.slackTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		ret.token = strings.TrimSpace(string(token))
+	}
+	return ret, nil
+}
+
+func (s *slack_notifier) name() string {
+	return "slack"
+}
+
+func (s *slack_notifier) kinds() []string {
+	return SLACK_NOTICE_KINDS
+}
+
+func (s *slack_notifier) notify(opt *collect_options, notice event_notice, entry *notified_event) error {
+	message := slackMessage(notice)
+	if s.token == "" {
+		return s.post(opt, s.webhookURL, message)
+	}
+
+	// entry.Thread is "<channel id>:<ts>" of the event's first message
+	channel, threadTS, threaded := strings.Cut(entry.Thread, ":")
+	if !threaded {
+		message.Channel = s.channel
+		resp, err := s.call(opt, "chat.postMessage", message)
+		if err != nil {
+			return err
+		}
+		entry.Thread = resp.Channel + ":" + resp.TS
+		return nil
+	}
+
+	reply := message
+	reply.Channel, reply.ThreadTS = channel, threadTS
+	if _, err := s.call(opt, "chat.postMessage", reply); err != nil {
+		return err
+	}
+	if notice.Kind == NOTICE_RESCHEDULED || notice.Kind == NOTICE_CANCELED {
+		// a failed edit is only logged; the reply went out, and sending it again would repeat it
+		current := slackMessage(event_notice{Kind: NOTICE_NEW, SentAt: notice.SentAt, InstanceID: notice.InstanceID, Event: notice.Event})
+		if notice.Kind == NOTICE_CANCELED {
+			current = message
+		}
+		current.Channel, current.TS = channel, threadTS
+		if _, err := s.call(opt, "chat.update", current); err != nil {
+			printError(fmt.Errorf("slack: updating the first message for %s: %w", notice.Event.EventID, err))
+		}
+	}
+	return nil
+}
+
+// call a Web API method with the bot token
+func (s *slack_notifier) call(opt *collect_options, method string, message slack_message) (*slack_response, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{"Authorization": {"Bearer " + s.token}}
+	var resp slack_response
+	err = withRetries(opt, "slack "+method, func() error {
+		respBody, err := postJSON(slackAPIURL+method, "slack "+method, body, header)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(respBody, &resp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.OK {
+		return nil, fmt.Errorf("slack %s: %s", method, resp.Error)
+	}
+	return &resp, nil
+}
+
+// post to an incoming webhook, which answers "ok", or an error status
+func (s *slack_notifier) post(opt *collect_options, url string, message slack_message) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return withRetries(opt, "slack incoming webhook", func() error {
+		_, err := postJSON(url, "slack incoming webhook", body, nil)
+		return err
+	})
+}
+
+// the notice as Block Kit: a header saying what happened, then the instance, event, window in UTC and in
+// each reader's own time zone, time remaining, and the description
+func slackMessage(notice event_notice) slack_message {
+	ev := notice.Event
+	var title string
+	switch notice.Kind {
+	case NOTICE_NEW:
+		title = "Scheduled maintenance"
+	case NOTICE_RESCHEDULED:
+		title = "Maintenance rescheduled"
+	case NOTICE_IN_WINDOW:
+		title = "Maintenance window started"
+	case NOTICE_CANCELED:
+		title = "Maintenance canceled"
+	}
+	title = fmt.Sprintf("%s: %s on %s", title, ev.Code, notice.InstanceID)
+
+	var notAfter time.Time
+	if ev.NotAfter != nil {
+		notAfter = *ev.NotAfter
+	}
+	blocks := []slack_block{
+		{Type: "header", Text: &slack_text{Type: "plain_text", Text: title}},
+		{Type: "section", Fields: []slack_text{
+			{Type: "mrkdwn", Text: "*Instance*\n" + notice.InstanceID},
+			{Type: "mrkdwn", Text: fmt.Sprintf("*Event*\n%s (%s)", ev.Code, ev.EventID)},
+			{Type: "mrkdwn", Text: "*Window (UTC)*\n" + formatWindow(ev.NotBefore, notAfter, time.UTC)},
+			{Type: "mrkdwn", Text: "*Window (your time)*\n" + slackWindow(ev.NotBefore, notAfter)},
+			{Type: "mrkdwn", Text: "*Starts*\n" + slackRemaining(notice)},
+			{Type: "mrkdwn", Text: "*State*\n" + ev.State},
+		}},
+	}
+	if notice.PreviousNotBefore != nil {
+		var previousNotAfter time.Time
+		if notice.PreviousNotAfter != nil {
+			previousNotAfter = *notice.PreviousNotAfter
+		}
+		blocks = append(blocks, slack_block{Type: "context", Elements: []slack_text{
+			{Type: "mrkdwn", Text: "Was " + formatWindow(*notice.PreviousNotBefore, previousNotAfter, time.UTC)},
+		}})
+	}
+	if description := strings.TrimSpace(ev.Description); description != "" {
+		blocks = append(blocks, slack_block{Type: "section", Text: &slack_text{Type: "plain_text", Text: description}})
+	}
+
+	return slack_message{
+		Text:   fmt.Sprintf("%s, %s", title, formatWindow(ev.NotBefore, notAfter, time.UTC)),
+		Blocks: blocks,
+	}
+}
+
+// the window with Slack date formatting, which each reader sees in their own time zone
+func slackWindow(notBefore, notAfter time.Time) string {
+	ret := slackDate(notBefore) + " -"
+	if !notAfter.IsZero() {
+		ret += " " + slackDate(notAfter)
+	}
+	return ret
+}
+
+// <!date^unix^format|fallback>; the fallback is UTC for clients that can't format it
+func slackDate(t time.Time) string {
+	return fmt.Sprintf("<!date^%d^{date_short_pretty} {time}|%s>", t.Unix(), t.UTC().Format(SHOW_TIME_FORMAT))
+}
+
+// like show's REMAINING column, as of when the notice was made
+func slackRemaining(notice event_notice) string {
+	ev := notice.Event
+	switch {
+	case notice.Kind == NOTICE_CANCELED:
+		return "canceled"
+	case ev.InWindow && ev.NotAfter != nil:
+		return "in window, ends in " + humanDuration(ev.NotAfter.Sub(notice.SentAt))
+	case ev.InWindow:
+		return "in window"
+	case ev.SecondsUntilStart > 0:
+		return "in " + humanDuration(time.Duration(ev.SecondsUntilStart)*time.Second)
+	default:
+		return "window passed"
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_slackMessage(t *testing.T) {
+	notBefore := time.Date(2020, 1, 21, 9, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(2 * time.Hour)
+	previous := notBefore.Add(-24 * time.Hour)
+	event := json_event{
+		EventID:           "instance-event-1d59937288b749b32",
+		Code:              "system-reboot",
+		State:             "active",
+		Description:       "scheduled reboot",
+		NotBefore:         notBefore,
+		NotAfter:          &notAfter,
+		SecondsUntilStart: int64((23*time.Hour + 20*time.Minute).Seconds()),
+	}
+	tests := []struct {
+		name   string
+		notice event_notice
+		want   []string
+	}{
+		{name: "new",
+			notice: event_notice{Kind: NOTICE_NEW, InstanceID: "i-jklmn", Event: event},
+			want: []string{
+				"Scheduled maintenance: system-reboot on i-jklmn",
+				"*Window (UTC)*\nTue 2020-01-21 09:00 UTC - Tue 2020-01-21 11:00 UTC",
+				"*Window (your time)*\n<!date^1579597200^{date_short_pretty} {time}|Tue 2020-01-21 09:00 UTC> - <!date^1579604400^",
+				"*Starts*\nin 23h 20m",
+				"scheduled reboot",
+			}},
+		{name: "rescheduled",
+			notice: event_notice{Kind: NOTICE_RESCHEDULED, InstanceID: "i-jklmn", Event: event, PreviousNotBefore: &previous},
+			want: []string{
+				"Maintenance rescheduled: system-reboot on i-jklmn",
+				"Was Mon 2020-01-20 09:00 UTC -",
+			}},
+		{name: "canceled",
+			notice: event_notice{Kind: NOTICE_CANCELED, InstanceID: "i-jklmn", Event: event},
+			want:   []string{"Maintenance canceled: system-reboot on i-jklmn", "*Starts*\ncanceled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// compare as JSON, to see the escaping Slack gets
+			data, _ := json.Marshal(slackMessage(tt.notice))
+			got := string(data)
+			for _, want := range tt.want {
+				want, _ := json.Marshal(want)
+				if !strings.Contains(got, strings.Trim(string(want), `"`)) {
+					t.Errorf("slackMessage() = %s\nwanted it to contain %s", got, want)
+				}
+			}
+		})
+	}
+}
+
+// a stand-in for Slack's Web API, recording each call
+type slack_api_call struct {
+	method  string
+	message slack_message
+}
+
+func helpSlackAPI(t *testing.T) *[]slack_api_call {
+	var calls []slack_api_call
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			w.Write([]byte(`{"ok":false,"error":"invalid_auth"}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		call := slack_api_call{method: strings.TrimPrefix(r.URL.Path, "/")}
+		json.Unmarshal(body, &call.message)
+		calls = append(calls, call)
+		w.Write([]byte(`{"ok":true,"channel":"C0123","ts":"1579500000.000100"}`))
+	}))
+	t.Cleanup(srv.Close)
+	original := slackAPIURL
+	slackAPIURL = srv.URL + "/"
+	t.Cleanup(func() { slackAPIURL = original })
+	return &calls
+}
+
+func Test_runNotifiers_slackThread(t *testing.T) {
+	helpNoRetrySleep(t)
+	calls := helpSlackAPI(t)
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	os.WriteFile(tokenFile, []byte("xoxb-test\n"), 0600)
+	opt := &collect_options{
+		slackTokenFile:   tokenFile,
+		slackChannel:     "#maintenance",
+		notifyLedgerPath: filepath.Join(dir, "notify.json"),
+	}
+	at := func(d time.Duration) string { return time.Now().Add(d).UTC().Format(AWS_EVENT_TIME_FORMAT) }
+	metadata := &fetched_metadata{instanceID: "i-jklmn", events: []maintenance_event{
+		{EventId: "ev-1", Code: "system-reboot", State: "active", NotBefore: at(48 * time.Hour)},
+	}}
+	run := func(want ...string) {
+		t.Helper()
+		*calls = nil
+		if err := runNotifiers(opt, metadata); err != nil {
+			t.Fatalf("runNotifiers() error = %v", err)
+		}
+		var got []string
+		for _, call := range *calls {
+			got = append(got, call.method)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("calls = %q, want %q", got, want)
+		}
+	}
+
+	run("chat.postMessage")
+	if m := (*calls)[0].message; m.Channel != "#maintenance" || m.ThreadTS != "" {
+		t.Errorf("first message = %+v", m)
+	}
+	run()
+
+	metadata.events[0].NotBefore = at(72 * time.Hour)
+	run("chat.postMessage", "chat.update")
+	reply, update := (*calls)[0].message, (*calls)[1].message
+	if reply.Channel != "C0123" || reply.ThreadTS != "1579500000.000100" || !strings.HasPrefix(reply.Text, "Maintenance rescheduled") {
+		t.Errorf("reply = %+v", reply)
+	}
+	if update.Channel != "C0123" || update.TS != "1579500000.000100" || !strings.HasPrefix(update.Text, "Scheduled maintenance") {
+		t.Errorf("update = %+v", update)
+	}
+
+	metadata.events[0].State = "canceled"
+	run("chat.postMessage", "chat.update")
+	if update := (*calls)[1].message; !strings.HasPrefix(update.Text, "Maintenance canceled") {
+		t.Errorf("update = %+v", update)
+	}
+	run()
+}
+
+func Test_runNotifiers_slackWebhook(t *testing.T) {
+	helpNoRetrySleep(t)
+	var received []slack_message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/services/T000/B000/SECRETSECRET" {
+			http.Error(w, "no_service", http.StatusNotFound)
+			return
+		}
+		var message slack_message
+		json.NewDecoder(r.Body).Decode(&message)
+		received = append(received, message)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	urlFile := filepath.Join(dir, "slack-webhook")
+	opt := &collect_options{slackWebhookURLFile: urlFile, notifyLedgerPath: filepath.Join(dir, "notify.json"), retries: 1}
+	metadata := &fetched_metadata{instanceID: "i-jklmn", events: []maintenance_event{
+		{EventId: "ev-1", Code: "system-reboot", State: "active", NotBefore: time.Now().Add(time.Hour).UTC().Format(AWS_EVENT_TIME_FORMAT)},
+	}}
+
+	// a revoked webhook is logged without its URL, which is a credential
+	os.WriteFile(urlFile, []byte(srv.URL+"/services/T000/B000/REVOKED\n"), 0600)
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	err := runNotifiers(opt, metadata)
+	log.SetOutput(os.Stderr)
+	if err != nil || len(received) != 0 {
+		t.Fatalf("runNotifiers() = %v, received %d", err, len(received))
+	}
+	if !strings.Contains(logged.String(), "404") || strings.Contains(logged.String(), "/services/") {
+		t.Errorf("logged %q, want the status without the URL", logged.String())
+	}
+
+	os.WriteFile(urlFile, []byte(srv.URL+"/services/T000/B000/SECRETSECRET\n"), 0600)
+	for range 2 {
+		if err := runNotifiers(opt, metadata); err != nil {
+			t.Fatalf("runNotifiers() error = %v", err)
+		}
+	}
+	if len(received) != 1 || received[0].Channel != "" || received[0].ThreadTS != "" || len(received[0].Blocks) == 0 {
+		t.Errorf("received = %+v", received)
+	}
+}
@@ -4,7 +4,7 @@ AWS metadata HTTP service
 Returns only a few specific endpoints (maintenance events and instance-id)
 """
 
-from datetime import datetime, timedelta
+from datetime import datetime, timedelta, timezone
 import json
 import random
 import string
@@ -79,6 +79,25 @@ async def scheduled(x_aws_ec2_metadata_token: Optional[str] = Header(None)):
     return ret
 
 
+@app.get("/latest/meta-data/spot/instance-action", response_class=PlainTextResponse)
+async def spot_instance_action(x_aws_ec2_metadata_token: Optional[str] = Header(None)):
+    """
+    Simulate a spot interruption notice, 1 time in 4; otherwise 404 like a
+    real instance with no notice pending
+    """
+    if x_aws_ec2_metadata_token and x_aws_ec2_metadata_token not in active_tokens:
+        raise HTTPException(status_code=401, detail="Unauthorized")
+
+    if random.choice(range(4)):
+        raise HTTPException(status_code=404, detail="Not Found")
+
+    in2m = (datetime.now() + timedelta(minutes=2)).astimezone(timezone.utc)
+    return json.dumps({
+        "action": random.choice(["stop", "terminate", "hibernate"]),
+        "time": in2m.strftime("%Y-%m-%dT%H:%M:%SZ"),
+    })
+
+
 @app.put("/latest/api/token")
 async def get_token(response: Response, x_aws_ec2_metadata_token_ttl_seconds: Optional[str] = Header(None)):
     if not x_aws_ec2_metadata_token_ttl_seconds:
@@ -89,6 +108,32 @@ async def get_token(response: Response, x_aws_ec2_metadata_token_ttl_seconds: Op
     return Response(content=token, media_type="text/plain")
 
 
+@app.get("/latest/dynamic/instance-identity/document", response_class=PlainTextResponse)
+async def identity_document(x_aws_ec2_metadata_token: Optional[str] = Header(None)):
+    """
+    A hardcoded identity document for our fake instance
+    """
+    if x_aws_ec2_metadata_token and x_aws_ec2_metadata_token not in active_tokens:
+        raise HTTPException(status_code=401, detail="Unauthorized")
+    return json.dumps({
+        "accountId": "123456789012",
+        "architecture": "x86_64",
+        "availabilityZone": "us-east-1a",
+        "imageId": "ami-0abcdef1234567890",
+        "instanceId": INSTANCE_ID,
+        "instanceType": "m5.large",
+        "region": "us-east-1",
+        "version": "2017-09-30",
+    }, indent=2)
+
+
+@app.get("/latest/meta-data/instance-life-cycle", response_class=PlainTextResponse)
+async def instance_life_cycle(x_aws_ec2_metadata_token: Optional[str] = Header(None)):
+    if x_aws_ec2_metadata_token and x_aws_ec2_metadata_token not in active_tokens:
+        raise HTTPException(status_code=401, detail="Unauthorized")
+    return "spot"
+
+
 @app.get("/1.0/meta-data/instance-id", response_class=PlainTextResponse)
 async def get_instance_id(x_aws_ec2_metadata_token: Optional[str] = Header(None)):
     """
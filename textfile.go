@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const TEXTFILE_NAME = "collect-aws-metadata.prom"
+const OPENMETRICS_TEXTFILE_NAME = "collect-aws-metadata.om" // node_exporter only reads *.prom, and can't parse OpenMetrics
+const JSON_FILE_NAME = "collect-aws-metadata.json"
+const DEFAULT_FILE_MODE = "0644"
+
+var errInvalidFileMode = errors.New("--file-mode must be an octal permission like 0644")
+var errCorruptStateFile = errors.New("unreadable state file")
+
+// the file collect writes in --textfiles-path for a --format
+func textfileName(format string) string {
+	switch format {
+	case FORMAT_OPENMETRICS:
+		return OPENMETRICS_TEXTFILE_NAME
+	case FORMAT_JSON:
+		return JSON_FILE_NAME
+	default:
+		return TEXTFILE_NAME
+	}
+}
+
+// write a file so readers only ever see the old or the new content, never a partial one.
+//
+// The content is written by `write` to a temp file in the same directory, fsynced, given `mode`
+// and (unless they are -1) `uid`/`gid`, then renamed over `path`. The temp file name does not end
+// in .prom so node_exporter never reads it.
+func writeFileAtomic(path string, mode os.FileMode, uid, gid int, write func(io.Writer) error) (err error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// on any failure, don't leave the temp file behind
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(mode); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err = tmp.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// persist the rename itself; not every platform can sync a directory, so this is best-effort
+	if d, dirErr := os.Open(dir); dirErr == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// read a JSON state file (the hook and notify ledgers, --state-path) into v; a missing file leaves v as
+// it is. A file that isn't valid JSON is an errCorruptStateFile.
+func loadStateFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w %s: %s", errCorruptStateFile, path, err)
+	}
+	return nil
+}
+
+// write v to a JSON state file with writeFileAtomic, so a crash can't leave half of it
+func saveStateFile(path string, mode os.FileMode, v any) error {
+	return writeFileAtomic(path, mode, -1, -1, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	})
+}
+
+// parse an octal permission string such as "0640"
+func parseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errInvalidFileMode
+	}
+	return os.FileMode(mode), nil
+}
+
+// resolve "user[:group]" (names or numeric ids) to a uid and gid; -1 means leave unchanged
+func parseFileOwner(s string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if s == "" {
+		return uid, gid, nil
+	}
+
+	userPart, groupPart, _ := strings.Cut(s, ":")
+	if userPart != "" {
+		if uid, err = strconv.Atoi(userPart); err != nil {
+			u, lookupErr := user.Lookup(userPart)
+			if lookupErr != nil {
+				return -1, -1, fmt.Errorf("--file-owner: %w", lookupErr)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if groupPart != "" {
+		if gid, err = strconv.Atoi(groupPart); err != nil {
+			g, lookupErr := user.LookupGroup(groupPart)
+			if lookupErr != nil {
+				return -1, -1, fmt.Errorf("--file-owner: %w", lookupErr)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_writeFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, TEXTFILE_NAME)
+
+	err := writeFileAtomic(path, 0640, -1, -1, func(w io.Writer) error {
+		_, err := fmt.Fprint(w, "first 1\n")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("writeFileAtomic() error = %v", err)
+	}
+	got, _ := os.ReadFile(path)
+	if string(got) != "first 1\n" {
+		t.Errorf("writeFileAtomic() wrote `%s`", got)
+	}
+	if st, _ := os.Stat(path); st.Mode().Perm() != 0640 {
+		t.Errorf("writeFileAtomic() mode = %o, want 0640", st.Mode().Perm())
+	}
+
+	// a failed write leaves the previous file alone, and no temp files
+	err = writeFileAtomic(path, 0640, -1, -1, func(w io.Writer) error {
+		fmt.Fprint(w, "half a li")
+		return errors.New("writer broke")
+	})
+	if err == nil {
+		t.Fatal("writeFileAtomic() wanted an error")
+	}
+	got, _ = os.ReadFile(path)
+	if string(got) != "first 1\n" {
+		t.Errorf("writeFileAtomic() clobbered the file after an error: `%s`", got)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("writeFileAtomic() left %d files behind, want 1", len(entries))
+	}
+
+	// a missing directory is an error
+	if err := writeFileAtomic(filepath.Join(dir, "nope", TEXTFILE_NAME), 0644, -1, -1, func(w io.Writer) error { return nil }); err == nil {
+		t.Error("writeFileAtomic() into a missing directory wanted an error")
+	}
+}
+
+func Test_parseFileMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{in: "0644", want: 0644},
+		{in: "600", want: 0600},
+		{in: "0999", wantErr: true},
+		{in: "01777", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseFileMode(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFileMode(%s) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseFileMode(%s) = %o, want %o", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseFileOwner(t *testing.T) {
+	tests := []struct {
+		in       string
+		uid, gid int
+		wantErr  bool
+	}{
+		{in: "", uid: -1, gid: -1},
+		{in: "1000", uid: 1000, gid: -1},
+		{in: "1000:1001", uid: 1000, gid: 1001},
+		{in: ":1001", uid: -1, gid: 1001},
+		{in: "root:root", uid: 0, gid: 0},
+		{in: "no-such-user-here", wantErr: true},
+		{in: "0:no-such-group-here", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			uid, gid, err := parseFileOwner(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseFileOwner(%s) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && (uid != tt.uid || gid != tt.gid) {
+				t.Errorf("parseFileOwner(%s) = %d:%d, want %d:%d", tt.in, uid, gid, tt.uid, tt.gid)
+			}
+		})
+	}
+}
+
+func Test_stateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	// missing is empty
+	got := map[string]int{"kept": 1}
+	if err := loadStateFile(path, &got); err != nil || !reflect.DeepEqual(got, map[string]int{"kept": 1}) {
+		t.Errorf("loadStateFile() of a missing file = %v, %v", got, err)
+	}
+
+	want := map[string]int{"a": 1, "b": 2}
+	if err := saveStateFile(path, 0600, want); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("saveStateFile() mode = %v, %v", info.Mode(), err)
+	}
+	got = map[string]int{}
+	if err := loadStateFile(path, &got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("loadStateFile() = %v, %v; want %v", got, err, want)
+	}
+
+	os.WriteFile(path, []byte("{not json"), 0600)
+	if err := loadStateFile(path, &got); !errors.Is(err, errCorruptStateFile) {
+		t.Errorf("loadStateFile() of a bad file error = %v, want %v", err, errCorruptStateFile)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const TOKEN_CACHE_MODE = 0600
+
+// what --token-cache-path holds between runs
+type token_cache struct {
+	BaseURL string    `json:"baseURL"` // a token is only good at the endpoint that issued it
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// use the token from --token-cache-path if it was issued by opt.baseURL and is not about to expire.
+//
+// The cache is only an optimization, so any problem with it just means fetching a new token.
+func loadCachedToken(opt *collect_options) bool {
+	if opt.tokenCachePath == "" {
+		return false
+	}
+
+	f, err := os.Open(opt.tokenCachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			printInfo(fmt.Sprintf("Ignoring token cache: %s", err))
+		}
+		return false
+	}
+	defer f.Close()
+
+	// refuse a token anyone but us could have read (or planted)
+	if st, err := f.Stat(); err != nil || st.Mode().Perm()&^TOKEN_CACHE_MODE != 0 {
+		printInfo(fmt.Sprintf("Ignoring token cache %s: it must be readable only by its owner", opt.tokenCachePath))
+		return false
+	}
+
+	var cached token_cache
+	if err := json.NewDecoder(f).Decode(&cached); err != nil {
+		printInfo(fmt.Sprintf("Ignoring token cache %s: %s", opt.tokenCachePath, err))
+		return false
+	}
+	if cached.BaseURL != opt.baseURL || cached.Token == "" || !tokenUsable(opt, cached.Expires) {
+		return false
+	}
+
+	opt.token = cached.Token
+	opt.tokenExpires = cached.Expires
+	return true
+}
+
+// write opt.token to --token-cache-path, readable only by the user running this
+func saveCachedToken(opt *collect_options) {
+	if opt.tokenCachePath == "" || opt.token == "" {
+		return
+	}
+	cached := token_cache{BaseURL: opt.baseURL, Token: opt.token, Expires: opt.tokenExpires}
+	err := writeFileAtomic(opt.tokenCachePath, TOKEN_CACHE_MODE, -1, -1, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(cached)
+	})
+	if err != nil {
+		printInfo(fmt.Sprintf("Could not write token cache: %s", err))
+	}
+}
+
+// forget the token, in memory and in --token-cache-path, so the next request fetches a new one
+func invalidateToken(opt *collect_options) {
+	opt.token = ""
+	opt.tokenExpires = time.Time{}
+	if opt.tokenCachePath != "" {
+		os.Remove(opt.tokenCachePath)
+	}
+}
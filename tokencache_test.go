@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a meta-data server that issues token-1, token-2, ... and only accepts the newest one
+func helpMakeATokenServer(tokenRequests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, DEFAULT_TOKEN_PATH) {
+			*tokenRequests++
+			fmt.Fprintf(w, "token-%d", *tokenRequests)
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != fmt.Sprintf("token-%d", *tokenRequests) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "i-jklmn")
+	}))
+}
+
+func Test_tokenCache_acrossRuns(t *testing.T) {
+	tokenRequests := 0
+	srv := helpMakeATokenServer(&tokenRequests)
+	defer srv.Close()
+	cachePath := filepath.Join(t.TempDir(), "token.json")
+
+	// each run starts with fresh options, like a new process
+	run := func() {
+		t.Helper()
+		opts := &collect_options{baseURL: srv.URL, tokenCachePath: cachePath, tokenTTL: DEFAULT_TOKEN_TTL}
+		if _, err := fetchPath(opts, DEFAULT_INSTANCE_ID_PATH); err != nil {
+			t.Fatalf("fetchPath() error = %v", err)
+		}
+	}
+
+	run()
+	run()
+	run()
+	if tokenRequests != 1 {
+		t.Errorf("3 runs requested %d tokens, want 1", tokenRequests)
+	}
+	st, err := os.Stat(cachePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode().Perm() != TOKEN_CACHE_MODE {
+		t.Errorf("token cache mode = %o, want %o", st.Mode().Perm(), TOKEN_CACHE_MODE)
+	}
+
+	// IMDS forgets the token (e.g. it was restarted); the cached one is rejected and replaced
+	tokenRequests++
+	run()
+	if tokenRequests != 3 {
+		t.Errorf("after a rejected token, requested %d tokens in total, want 3", tokenRequests)
+	}
+	opts := &collect_options{baseURL: srv.URL, tokenCachePath: cachePath, tokenTTL: DEFAULT_TOKEN_TTL}
+	if !loadCachedToken(opts) || opts.token != "token-3" {
+		t.Errorf("token cache holds %q, want token-3", opts.token)
+	}
+}
+
+func Test_loadCachedToken(t *testing.T) {
+	write := func(t *testing.T, mode os.FileMode, content string) string {
+		path := filepath.Join(t.TempDir(), "token.json")
+		os.WriteFile(path, []byte(content), mode)
+		os.Chmod(path, mode)
+		return path
+	}
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	good := `{"baseURL": "http://169.254.169.254", "token": "cached", "expires": "` + expires + `"}`
+
+	tests := []struct {
+		name string
+		path func(t *testing.T) string
+		want bool
+	}{
+		{name: "good",
+			path: func(t *testing.T) string { return write(t, 0600, good) },
+			want: true},
+		{name: "no cache configured",
+			path: func(t *testing.T) string { return "" },
+			want: false},
+		{name: "missing file",
+			path: func(t *testing.T) string { return filepath.Join(t.TempDir(), "nope.json") },
+			want: false},
+		{name: "readable by others",
+			path: func(t *testing.T) string { return write(t, 0644, good) },
+			want: false},
+		{name: "another endpoint's token",
+			path: func(t *testing.T) string {
+				return write(t, 0600, strings.Replace(good, "169.254.169.254", "[fd00:ec2::254]", 1))
+			},
+			want: false},
+		{name: "about to expire",
+			path: func(t *testing.T) string {
+				soon := time.Now().Add(TOKEN_REFRESH_MARGIN / 2).UTC().Format(time.RFC3339)
+				return write(t, 0600, strings.Replace(good, expires, soon, 1))
+			},
+			want: false},
+		{name: "garbage",
+			path: func(t *testing.T) string { return write(t, 0600, "token=cached") },
+			want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &collect_options{baseURL: DEFAULT_BASE_URL, tokenCachePath: tt.path(t), tokenTTL: DEFAULT_TOKEN_TTL}
+			if got := loadCachedToken(opts); got != tt.want {
+				t.Errorf("loadCachedToken() = %v, want %v", got, tt.want)
+			}
+			if tt.want && opts.token != "cached" {
+				t.Errorf("loadCachedToken() token = %q, want cached", opts.token)
+			}
+		})
+	}
+}
+
+func Test_saveCachedToken(t *testing.T) {
+	dir := t.TempDir()
+
+	// nothing to save for IMDSv1
+	opts := &collect_options{baseURL: DEFAULT_BASE_URL, tokenCachePath: filepath.Join(dir, "v1.json")}
+	saveCachedToken(opts)
+	if _, err := os.Stat(opts.tokenCachePath); !os.IsNotExist(err) {
+		t.Errorf("saveCachedToken() without a token wrote a file")
+	}
+
+	// an unwritable path is logged, not fatal
+	opts = &collect_options{baseURL: DEFAULT_BASE_URL, token: "t", tokenCachePath: filepath.Join(dir, "missing", "t.json")}
+	saveCachedToken(opts)
+}
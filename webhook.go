@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// the header with the HMAC-SHA256 of the body, keyed with --webhook-secret-file, as "sha256=<hex>"
+const WEBHOOK_SIGNATURE_HEADER = "X-Signature-256"
+
+// the notices the webhook sends; receivers only have to handle these kinds
+var WEBHOOK_NOTICE_KINDS = []string{NOTICE_NEW, NOTICE_RESCHEDULED, NOTICE_IN_WINDOW}
+
+// POSTs each notice as JSON to --webhook-url
+type webhook_notifier struct {
+	url    string
+	secret []byte // nil to send unsigned
+}
+
+func newWebhookNotifier(opt *collect_options) (*webhook_notifier, error) {
+	ret := &webhook_notifier{url: opt.webhookURL}
+	if opt.webhookSecretFile != "" {
+		secret, err := os.ReadFile(opt.webhookSecretFile)
+		if err != nil {
+			return nil, err
+		}
+		ret.secret = []byte(strings.TrimSpace(string(secret)))
+	}
+	return ret, nil
+}
+
+func (w *webhook_notifier) name() string {
+	return "webhook"
+}
+
+func (w *webhook_notifier) kinds() []string {
+	return WEBHOOK_NOTICE_KINDS
+}
+
+func (w *webhook_notifier) notify(opt *collect_options, notice event_notice, _ *notified_event) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if w.secret != nil {
+		header.Set(WEBHOOK_SIGNATURE_HEADER, webhookSignature(w.secret, body))
+	}
+	return withRetries(opt, w.name(), func() error {
+		_, err := postJSON(w.url, w.name(), body, header)
+		return err
+	})
+}
+
+// "sha256=" and the hex HMAC-SHA256 of body; the receiver computes the same over the raw body to check it
+func webhookSignature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_webhookSignature(t *testing.T) {
+	got := webhookSignature([]byte("key"), []byte("The quick brown fox jumps over the lazy dog"))
+	want := "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"
+	if got != want {
+		t.Errorf("webhookSignature() = %s, want %s", got, want)
+	}
+}
+
+func Test_runNotifiers_webhook(t *testing.T) {
+	helpNoRetrySleep(t)
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	os.WriteFile(secretFile, []byte("s3cret\n"), 0600)
+
+	failing := false
+	failKind := "" // fail only notices of this kind
+	var received []event_notice
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(WEBHOOK_SIGNATURE_HEADER) != webhookSignature([]byte("s3cret"), body) {
+			http.Error(w, "bad signature", 401)
+			return
+		}
+		if failing {
+			http.Error(w, "down", 502)
+			return
+		}
+		var notice event_notice
+		json.Unmarshal(body, &notice)
+		if notice.Kind == failKind {
+			http.Error(w, "down", 502)
+			return
+		}
+		received = append(received, notice)
+	}))
+	defer srv.Close()
+
+	opt := &collect_options{
+		webhookURL:        srv.URL,
+		webhookSecretFile: secretFile,
+		notifyLedgerPath:  filepath.Join(dir, "notify.json"),
+		retries:           1,
+	}
+	at := func(d time.Duration) string { return time.Now().Add(d).UTC().Format(AWS_EVENT_TIME_FORMAT) }
+	metadata := &fetched_metadata{instanceID: "i-jklmn", events: []maintenance_event{
+		{EventId: "ev-1", Code: "system-reboot", State: "active", NotBefore: at(48 * time.Hour)},
+	}}
+	run := func(wantReceived int) {
+		t.Helper()
+		if err := runNotifiers(opt, metadata); err != nil {
+			t.Fatalf("runNotifiers() error = %v", err)
+		}
+		if len(received) != wantReceived {
+			t.Fatalf("received %d notices, want %d: %+v", len(received), wantReceived, received)
+		}
+	}
+
+	run(1)
+	if received[0].Kind != NOTICE_NEW || received[0].InstanceID != "i-jklmn" || received[0].Event.Code != "system-reboot" {
+		t.Errorf("first notice = %+v", received[0])
+	}
+	run(1) // sent already
+
+	// while the webhook is down, nothing is recorded, so it goes out once it's back
+	metadata.events[0].NotBefore = at(72 * time.Hour)
+	failing = true
+	run(1)
+	failing = false
+	run(2)
+	if received[1].Kind != NOTICE_RESCHEDULED || received[1].PreviousNotBefore == nil {
+		t.Errorf("second notice = %+v", received[1])
+	}
+
+	// rescheduled again, and now in its window; when the rescheduled notice fails, in_window waits for it,
+	// and the new window isn't recorded as told, so both go out in order next time
+	metadata.events[0].NotBefore = at(-time.Minute)
+	failKind = NOTICE_RESCHEDULED
+	run(2)
+	failKind = ""
+	run(4)
+	if received[2].Kind != NOTICE_RESCHEDULED || received[3].Kind != NOTICE_IN_WINDOW {
+		t.Errorf("notices = %+v", received[2:])
+	}
+	run(4)
+
+	// the webhook doesn't send canceled notices
+	metadata.events[0].State = "canceled"
+	run(4)
+
+	// a vanished event is forgotten
+	metadata.events = nil
+	run(4)
+	ledger := notify_ledger{}
+	if err := loadStateFile(opt.notifyLedgerPath, &ledger); err != nil || len(ledger["webhook"]) != 0 {
+		t.Errorf("ledger = %v, %v", ledger, err)
+	}
+}
+
+func Test_newWebhookNotifier(t *testing.T) {
+	if _, err := newWebhookNotifier(&collect_options{webhookURL: "http://x", webhookSecretFile: "/nonexistent"}); err == nil {
+		t.Error("newWebhookNotifier() with a missing secret file, wanted an error")
+	}
+	w, err := newWebhookNotifier(&collect_options{webhookURL: "http://x"})
+	if err != nil || w.secret != nil {
+		t.Errorf("newWebhookNotifier() without a secret = %+v, %v", w, err)
+	}
+}